@@ -0,0 +1,220 @@
+// Package backend reads and writes the physical entries of Vault storage
+// backends in a number of formats.
+//
+// Every format is opened from a specification of the form scheme:address:
+//
+//	file:PATH            a Vault filesystem storage backend
+//	consul:ADDR          the KV store of a live Consul agent, such as
+//	                     127.0.0.1:8500 or https://consul.example:8501
+//	consul-export:FILE   a JSON-serialised Consul KV tree, as read and
+//	                     written by 'consul kv export' and 'consul kv import';
+//	                     if FILE does not exist, the series written by
+//	                     SplitConsulExportSink is read instead
+//	consul-txn:DIR       a directory of Consul transaction API payloads,
+//	                     each of up to 64 KV set operations
+//	jsonl:FILE           one JSON object per line, with key and base64
+//	                     value fields; - is standard input or output
+//	inmem:NAME           a Vault in-memory backend, shared by name within
+//	                     the process
+//
+// Entries are copied verbatim.  Nothing here requires the master key.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/physical"
+)
+
+const (
+	SchemeFile         = "file"
+	SchemeConsul       = "consul"
+	SchemeConsulExport = "consul-export"
+	SchemeConsulTxn    = "consul-txn"
+	SchemeJSONL        = "jsonl"
+	SchemeInmem        = "inmem"
+)
+
+// Schemes lists every supported scheme.
+var Schemes = []string{SchemeFile, SchemeConsul, SchemeConsulExport, SchemeConsulTxn, SchemeJSONL, SchemeInmem}
+
+// Source yields physical entries.
+type Source interface {
+	// ReadEntry returns the next entry, or io.EOF once every entry has
+	// been read.  Once ctx is cancelled, ReadEntry returns ctx.Err(), not
+	// io.EOF, so that a cancelled read is never mistaken for a complete
+	// one.
+	ReadEntry(ctx context.Context) (*physical.Entry, error)
+	Close() error
+}
+
+// Sink accepts physical entries.  Formats that are written as a single
+// stream are incomplete until Close returns successfully.
+type Sink interface {
+	WriteEntry(ctx context.Context, entry *physical.Entry) error
+	Close() error
+}
+
+type Options struct {
+	// ConsulPath is the Consul key prefix for Vault data.  See
+	// https://www.vaultproject.io/docs/configuration/storage/consul.html#path
+	ConsulPath string
+	// ConsulToken is the ACL token presented to a live Consul agent.  If
+	// empty, CONSUL_HTTP_TOKEN is used.
+	ConsulToken string
+	// ConsulTLS configures TLS for a live Consul agent.  Empty fields are
+	// taken from the CONSUL_* environment variables.
+	ConsulTLS api.TLSConfig
+	// ConsulMaxValueSize is the largest value, in bytes, written to Consul
+	// or to a Consul export.  Zero is no limit.
+	ConsulMaxValueSize int
+	// ConsulSplitSize, if positive, splits Consul export output into a
+	// series of files of about this many bytes each.  See SplitPath.
+	ConsulSplitSize int
+	// Parallel bounds the concurrent operations against a physical
+	// backend.  Defaults to DefaultParallel.
+	Parallel int
+	// Resume, if not nil, reopens a sink at a position reported by its
+	// Checkpoint method instead of starting afresh.  Sinks that write every
+	// entry in place ignore it.
+	Resume *SinkPosition
+	Logger hclog.Logger
+}
+
+// ParseSpec splits a specification into its scheme and address.
+func ParseSpec(spec string) (scheme, addr string, err error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("%s: expected scheme:address; schemes are %s", spec, strings.Join(Schemes, ", "))
+	}
+	scheme, addr = spec[:i], spec[i+1:]
+	for _, s := range Schemes {
+		if s == scheme {
+			if addr == "" {
+				return "", "", fmt.Errorf("%s: missing address", spec)
+			}
+			return scheme, addr, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s: unknown scheme %q; schemes are %s", spec, scheme, strings.Join(Schemes, ", "))
+}
+
+// OpenSource opens the source named by spec.
+func OpenSource(ctx context.Context, spec string, opts *Options) (Source, error) {
+	scheme, addr, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	switch scheme {
+	case SchemeFile:
+		backend, err := NewFileBackend(addr, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return NewPhysicalSource(ctx, backend, opts.Parallel), nil
+	case SchemeConsul:
+		client, err := NewConsulClient(addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return OpenConsulSource(ctx, client, opts.ConsulPath)
+	case SchemeConsulExport:
+		if isSplitExport(addr) {
+			return OpenSplitConsulExportSource(addr, opts.ConsulPath)
+		}
+		return OpenConsulExportSource(addr, opts.ConsulPath)
+	case SchemeConsulTxn:
+		return OpenTxnSource(addr, opts.ConsulPath)
+	case SchemeJSONL:
+		return OpenJSONLSource(addr)
+	default:
+		return NewPhysicalSource(ctx, inmemBackend(addr, opts.Logger), opts.Parallel), nil
+	}
+}
+
+// OpenSink opens the sink named by spec.
+func OpenSink(ctx context.Context, spec string, opts *Options) (Sink, error) {
+	scheme, addr, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	switch scheme {
+	case SchemeFile:
+		backend, err := NewFileBackend(addr, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return NewPhysicalSink(backend), nil
+	case SchemeConsul:
+		client, err := NewConsulClient(addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return OpenConsulSink(client, opts.ConsulPath, opts.ConsulMaxValueSize)
+	case SchemeConsulExport:
+		if opts.Resume != nil && opts.ConsulSplitSize > 0 {
+			return ResumeSplitConsulExportSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize, opts.ConsulSplitSize, *opts.Resume)
+		}
+		if opts.Resume != nil {
+			return ResumeConsulExportSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize, opts.Resume.Offset)
+		}
+		if opts.ConsulSplitSize > 0 {
+			return OpenSplitConsulExportSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize, opts.ConsulSplitSize)
+		}
+		return OpenConsulExportSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize)
+	case SchemeConsulTxn:
+		if opts.Resume != nil {
+			return ResumeTxnSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize, *opts.Resume)
+		}
+		return OpenTxnSink(addr, opts.ConsulPath, opts.ConsulMaxValueSize)
+	case SchemeJSONL:
+		if opts.Resume != nil {
+			return ResumeJSONLSink(addr, opts.Resume.Offset)
+		}
+		return OpenJSONLSink(addr)
+	default:
+		return NewPhysicalSink(inmemBackend(addr, opts.Logger)), nil
+	}
+}
+
+func (o *Options) withDefaults() *Options {
+	c := Options{}
+	if o != nil {
+		c = *o
+	}
+	if c.ConsulPath == "" {
+		c.ConsulPath = "vault"
+	}
+	if c.Logger == nil {
+		c.Logger = hclog.NewNullLogger()
+	}
+	return &c
+}
+
+// Copy writes every entry read from src to dst.  The number of entries
+// copied is returned.  Neither src nor dst is closed.
+func Copy(ctx context.Context, dst Sink, src Source) (int, error) {
+	var n int
+	for {
+		entry, err := src.ReadEntry(ctx)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := dst.WriteEntry(ctx, entry); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
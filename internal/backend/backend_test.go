@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+// readEntries returns every entry read from src.
+func readEntries(t *testing.T, src Source) []*physical.Entry {
+	t.Helper()
+	got := &sliceSource{}
+	if _, err := Copy(context.Background(), &sliceSink{source: got}, src); err != nil {
+		t.Fatal(err)
+	}
+	return got.entries
+}
+
+func checkEntries(t *testing.T, got, want []*physical.Entry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Key != want[i].Key || !bytes.Equal(got[i].Value, want[i].Value) {
+			t.Fatalf("entry %d: got %s=%q, want %s=%q", i, got[i].Key, got[i].Value, want[i].Key, want[i].Value)
+		}
+	}
+}
+
+// binaryEntries returns n entries whose values are not valid UTF-8.
+func binaryEntries(n int) []*physical.Entry {
+	var entries []*physical.Entry
+	for i := 0; i < n; i++ {
+		entries = append(entries, &physical.Entry{
+			Key:   fmt.Sprintf("logical/%05d", i),
+			Value: []byte{0, 0xff, '\n', byte(i)},
+		})
+	}
+	return entries
+}
+
+func TestInmemRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	entries := binaryEntries(100)
+
+	sink, err := OpenSink(ctx, "inmem:round-trip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Copy(ctx, sink, &sliceSource{entries: entries}); err != nil || n != len(entries) {
+		t.Fatalf("copied %d entries: %v", n, err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenSource(ctx, "inmem:round-trip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
+
+func TestCopyFiltered(t *testing.T) {
+	ctx := context.Background()
+	entries := testEntries(20)
+	f := &Filter{Exclude: []string{"logical/0001*"}}
+
+	sink, err := OpenSink(ctx, "inmem:copy-filtered", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, FilterSource(&sliceSource{entries: entries}, f)); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenSource(ctx, "inmem:copy-filtered", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries[:10])
+}
+
+func TestJSONLRoundTrip(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.jsonl")
+	entries := binaryEntries(100)
+
+	sink, err := OpenJSONLSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(context.Background(), sink, &sliceSource{entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenJSONLSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
+
+func TestJSONLResume(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.jsonl")
+	entries := binaryEntries(20)
+
+	// Entries written after the checkpoint are discarded on resume.
+	sink, err := OpenJSONLSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[:10]}); err != nil {
+		t.Fatal(err)
+	}
+	pos, err := sink.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: testEntries(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err = ResumeJSONLSink(path, pos.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[10:]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenJSONLSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
+
+// TestSourceCancelled checks that every source reports cancellation, and
+// never io.EOF, once its context is cancelled.
+func TestSourceCancelled(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	c := newFakeConsul(t)
+	defer c.Close()
+
+	specs := []string{
+		"inmem:cancelled",
+		"jsonl:" + filepath.Join(dir, "vault.jsonl"),
+		"consul-export:" + filepath.Join(dir, "vault.json"),
+		"consul-txn:" + filepath.Join(dir, "txn"),
+		"consul:" + c.srv.URL,
+	}
+	for _, spec := range specs {
+		sink, err := OpenSink(context.Background(), spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Copy(context.Background(), sink, &sliceSource{entries: testEntries(3)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		src, err := OpenSource(ctx, spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		// Every entry may already have been read ahead.
+		for i := 0; i < 5; i++ {
+			if _, err = src.ReadEntry(ctx); err != nil {
+				break
+			}
+		}
+		if err != context.Canceled {
+			t.Errorf("%s: got %v, want %v", spec, err, context.Canceled)
+		}
+		src.Close() // nolint: errcheck
+	}
+}
@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+// CheckpointInterval is the number of entries copied between checkpoints.
+const CheckpointInterval = 1000
+
+// Checkpoint records the progress of an interrupted copy.
+type Checkpoint struct {
+	// LastKey is the last source key written durably to the sink.
+	LastKey string `json:"last_key"`
+	// Entries is the number of entries written durably to the sink.
+	Entries int `json:"entries"`
+	// Position is where the sink should resume writing.
+	Position SinkPosition `json:"position"`
+}
+
+// SinkPosition locates the end of a sink's durable output.  Its meaning
+// depends on the sink; sinks that write every entry in place ignore it.
+type SinkPosition struct {
+	// File is the number of files of a series that were started.
+	File int `json:"file,omitempty"`
+	// Offset is the length of the last file of the series, or of the only
+	// file.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// Checkpointer is implemented by sinks that can make everything written so
+// far durable, and report where to resume.  Sinks that implement
+// Checkpointer are reopened at a SinkPosition by setting Options.Resume.
+type Checkpointer interface {
+	Checkpoint() (SinkPosition, error)
+}
+
+// CheckpointPath returns the default checkpoint file for a copy to
+// outputPath.
+func CheckpointPath(outputPath string) string {
+	return filepath.Clean(outputPath) + ".checkpoint"
+}
+
+// LoadCheckpoint reads a checkpoint written by CopyWithCheckpoints.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.LastKey == "" {
+		return nil, fmt.Errorf("%s: missing last_key", path)
+	}
+	return c, nil
+}
+
+// save replaces the checkpoint at path.
+func (c *Checkpoint) save(path string) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// CopyWithCheckpoints is Copy, recording a checkpoint at path every
+// CheckpointInterval entries, and again if ctx is cancelled.  dst must
+// implement Checkpointer.
+//
+// If resume is not nil, dst must have been opened at resume.Position, and
+// source entries up to and including resume.LastKey are skipped.  Sources
+// must therefore yield entries in the same order on every run.
+//
+// The total number of entries written, including those of earlier runs, is
+// returned.  The checkpoint is left in place; remove it once dst has been
+// closed successfully.
+func CopyWithCheckpoints(ctx context.Context, dst Sink, src Source, path string, resume *Checkpoint) (int, error) {
+	cp, ok := dst.(Checkpointer)
+	if !ok {
+		return 0, fmt.Errorf("%T does not support checkpoints", dst)
+	}
+
+	state := &Checkpoint{}
+	if resume != nil {
+		*state = *resume
+		src = &skipSource{Source: src, lastKey: resume.LastKey}
+	}
+
+	var (
+		lastKey string
+		n       int
+	)
+	checkpoint := func() error {
+		if n == 0 {
+			return nil
+		}
+		pos, err := cp.Checkpoint()
+		if err != nil {
+			return err
+		}
+		state.LastKey = lastKey
+		state.Entries += n
+		state.Position = pos
+		n = 0
+		return state.save(path)
+	}
+
+	for {
+		entry, err := src.ReadEntry(ctx)
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == io.EOF {
+			return state.Entries + n, nil
+		}
+		if err != nil {
+			// Every entry read before the interruption has been written.
+			if ctx.Err() != nil {
+				if cpErr := checkpoint(); cpErr != nil {
+					return state.Entries + n, cpErr
+				}
+			}
+			return state.Entries + n, err
+		}
+
+		if err := dst.WriteEntry(ctx, entry); err != nil {
+			return state.Entries + n, err
+		}
+		lastKey = entry.Key
+		n++
+
+		if n == CheckpointInterval {
+			if err := checkpoint(); err != nil {
+				return state.Entries + n, err
+			}
+		}
+	}
+}
+
+// skipSource discards entries up to and including lastKey.
+type skipSource struct {
+	Source
+	lastKey string
+	found   bool
+}
+
+func (s *skipSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	for !s.found {
+		entry, err := s.Source.ReadEntry(ctx)
+		if err == io.EOF {
+			return nil, fmt.Errorf("checkpoint key %s not found in source", s.lastKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.found = entry.Key == s.lastKey
+	}
+	return s.Source.ReadEntry(ctx)
+}
+
+// PrepareCheckpoint returns the checkpoint at path to resume from.  If
+// resume is false, any stale checkpoint at path is removed and nil is
+// returned.
+func PrepareCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	if !resume {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	c, err := LoadCheckpoint(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: no checkpoint to resume from", path)
+	}
+	return c, err
+}
@@ -0,0 +1,158 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+// sliceSource returns entries in order.  If cancelAt is positive, cancel is
+// called before entry cancelAt is returned, and the context's error is
+// returned instead.
+type sliceSource struct {
+	entries  []*physical.Entry
+	cancelAt int
+	cancel   context.CancelFunc
+	n        int
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+func (s *sliceSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	if s.cancelAt > 0 && s.n == s.cancelAt {
+		s.cancel()
+		return nil, ctx.Err()
+	}
+	if s.n == len(s.entries) {
+		return nil, io.EOF
+	}
+	s.n++
+	return s.entries[s.n-1], nil
+}
+
+func testEntries(n int) []*physical.Entry {
+	var entries []*physical.Entry
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("logical/%05d", i)
+		entries = append(entries, &physical.Entry{Key: k, Value: []byte(k)})
+	}
+	return entries
+}
+
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "backend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCopyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &sliceSource{entries: testEntries(10), cancelAt: 5, cancel: cancel}
+	dst := NewPhysicalSink(newTestBackend(t))
+
+	n, err := Copy(ctx, dst, src)
+	if err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if n != 5 {
+		t.Errorf("copied %d entries, want 5", n)
+	}
+}
+
+func TestCopyWithCheckpointsCancelled(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "checkpoint")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &sliceSource{entries: testEntries(CheckpointInterval + 10), cancelAt: CheckpointInterval + 5, cancel: cancel}
+	dst := NewPhysicalSink(newTestBackend(t))
+
+	if _, err := CopyWithCheckpoints(ctx, dst, src, path, nil); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := src.entries[CheckpointInterval+4].Key; cp.LastKey != want || cp.Entries != CheckpointInterval+5 {
+		t.Errorf("got checkpoint after %d entries at %s, want %d at %s", cp.Entries, cp.LastKey, CheckpointInterval+5, want)
+	}
+}
+
+func TestCopyWithCheckpointsResume(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	entries := testEntries(2*CheckpointInterval + 100)
+
+	want := filepath.Join(dir, "want.json")
+	wantSink, err := OpenConsulExportSink(want, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(context.Background(), wantSink, &sliceSource{entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wantSink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt a copy part way through, then resume it.
+	got := filepath.Join(dir, "got.json")
+	path := got + ".checkpoint"
+	ctx, cancel := context.WithCancel(context.Background())
+	sink, err := OpenConsulExportSink(got, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &sliceSource{entries: entries, cancelAt: CheckpointInterval + 50, cancel: cancel}
+	if _, err := CopyWithCheckpoints(ctx, sink, src, path, nil); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err = ResumeConsulExportSink(got, "vault", 0, cp.Position.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := CopyWithCheckpoints(context.Background(), sink, &sliceSource{entries: entries}, path, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(entries) {
+		t.Errorf("copied %d entries, want %d", n, len(entries))
+	}
+
+	wantBuf, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotBuf, err := ioutil.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBuf, wantBuf) {
+		t.Error("resumed export differs from an uninterrupted one")
+	}
+}
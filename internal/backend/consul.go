@@ -0,0 +1,282 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/vault/physical"
+)
+
+const (
+	// maxTxnOps is the most operations Consul accepts in one transaction.
+	maxTxnOps = 64
+
+	// maxTxnSize bounds the request body of one transaction.  Consul
+	// rejects transactions larger than its KV value limit, 512 KiB by
+	// default.  Values are base64-encoded in the request.
+	maxTxnSize = 512 * 1024
+
+	// txnFraming is the size of a transaction request outside of its
+	// operations: the enclosing brackets and the newline that json.Encoder
+	// appends, less the separator after the last operation.
+	txnFraming = 2
+)
+
+// NewConsulClient returns a client for the Consul agent at addr.  addr may
+// carry an http:// or https:// scheme.  Settings not given in opts are taken
+// from the standard CONSUL_HTTP_* environment variables.
+func NewConsulClient(addr string, opts *Options) (*api.Client, error) {
+	conf := api.DefaultConfig()
+	conf.Address = addr
+	if opts.ConsulToken != "" {
+		conf.Token = opts.ConsulToken
+	}
+	tls := opts.ConsulTLS
+	if tls.Address != "" {
+		conf.TLSConfig.Address = tls.Address
+	}
+	if tls.CAFile != "" {
+		conf.TLSConfig.CAFile = tls.CAFile
+	}
+	if tls.CAPath != "" {
+		conf.TLSConfig.CAPath = tls.CAPath
+	}
+	if tls.CertFile != "" {
+		conf.TLSConfig.CertFile = tls.CertFile
+	}
+	if tls.KeyFile != "" {
+		conf.TLSConfig.KeyFile = tls.KeyFile
+	}
+	if tls.InsecureSkipVerify {
+		conf.TLSConfig.InsecureSkipVerify = true
+	}
+	return api.NewClient(conf)
+}
+
+// ConsulSource reads Vault data from a live Consul KV store.  The key list
+// is taken once when the source is opened; values are then fetched in
+// read-only transactions of up to 64 keys.
+type ConsulSource struct {
+	kv        *api.KV
+	keyPrefix string
+	keys      []string
+	pending   []*physical.Entry
+}
+
+func OpenConsulSource(ctx context.Context, client *api.Client, consulPath string) (*ConsulSource, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := client.KV()
+	q := (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx)
+	listPrefix := keyPrefix
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+	keys, _, err := kv.Keys(listPrefix, "", q)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ConsulSource{kv: kv, keyPrefix: keyPrefix}
+	for _, k := range keys {
+		if !KeyHasPrefix(k, keyPrefix) || strings.HasSuffix(k, "/") {
+			continue
+		}
+		s.keys = append(s.keys, k)
+	}
+	sort.Strings(s.keys)
+	return s, nil
+}
+
+func (s *ConsulSource) Close() error {
+	return nil
+}
+
+func (s *ConsulSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.pending) == 0 {
+		if err := s.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.pending) == 0 {
+		return nil, io.EOF
+	}
+	entry := s.pending[0]
+	s.pending = s.pending[1:]
+	return entry, nil
+}
+
+// fetch reads the values of the next batch of keys.
+func (s *ConsulSource) fetch(ctx context.Context) error {
+	n := len(s.keys)
+	if n > maxTxnOps {
+		n = maxTxnOps
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := s.keys[:n]
+	s.keys = s.keys[n:]
+
+	ops := make(api.KVTxnOps, 0, len(batch))
+	for _, k := range batch {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVGet, Key: k})
+	}
+	q := (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx)
+	ok, resp, _, err := s.kv.Txn(ops, q)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The store should be quiesced.
+		return txnError(ops, resp)
+	}
+	if len(resp.Results) != len(batch) {
+		return fmt.Errorf("consul transaction: expected %d results, got %d", len(batch), len(resp.Results))
+	}
+
+	for _, pair := range resp.Results {
+		s.pending = append(s.pending, &physical.Entry{
+			Key:   KeyStripPrefix(pair.Key, s.keyPrefix),
+			Value: pair.Value,
+		})
+	}
+	return nil
+}
+
+// ConsulSink writes Vault data to a live Consul KV store.  Entries are
+// written in transactions of up to 64 operations, each applied atomically.
+// Entries are not all written until Close returns successfully.
+type ConsulSink struct {
+	kv           *api.KV
+	keyPrefix    string
+	maxValueSize int
+	batch        txnBatch
+}
+
+// OpenConsulSink returns a sink that writes through client.  Entries with
+// values larger than maxValueSize bytes are refused.  A maxValueSize of zero
+// or less is no limit.
+func OpenConsulSink(client *api.Client, consulPath string, maxValueSize int) (*ConsulSink, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulSink{kv: client.KV(), keyPrefix: keyPrefix, maxValueSize: maxValueSize}, nil
+}
+
+func (s *ConsulSink) Close() error {
+	return s.flush(context.Background())
+}
+
+// Checkpoint commits the pending transaction.
+func (s *ConsulSink) Checkpoint() (SinkPosition, error) {
+	return SinkPosition{}, s.flush(context.Background())
+}
+
+func (s *ConsulSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	key := KeyAddPrefix(entry.Key, s.keyPrefix)
+	if err := checkValueSize(key, len(entry.Value), s.maxValueSize); err != nil {
+		return err
+	}
+	size := txnOpSize(key, entry.Value)
+
+	// A value too large for a transaction may still fit in a plain PUT,
+	// which carries the value unencoded.
+	if size+txnFraming > maxTxnSize {
+		if err := s.flush(ctx); err != nil {
+			return err
+		}
+		pair := &api.KVPair{Key: key, Value: entry.Value}
+		if _, err := s.kv.Put(pair, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		return nil
+	}
+
+	if !s.batch.fits(size) {
+		if err := s.flush(ctx); err != nil {
+			return err
+		}
+	}
+	s.batch.add(&api.KVTxnOp{Verb: api.KVSet, Key: key, Value: entry.Value}, size)
+	return nil
+}
+
+func (s *ConsulSink) flush(ctx context.Context) error {
+	ops := s.batch.take()
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ok, resp, _, err := s.kv.Txn(ops, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return txnError(ops, resp)
+	}
+	return nil
+}
+
+// txnBatch accumulates operations within Consul's transaction limits.
+type txnBatch struct {
+	ops  api.KVTxnOps
+	size int
+}
+
+// txnOpSize returns the size of a set operation in a transaction request,
+// including its separator.
+func txnOpSize(key string, value []byte) int {
+	// Marshalling a TxnOp cannot fail.
+	buf, _ := json.Marshal(&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value}})
+	return len(buf) + 1
+}
+
+// fits reports whether an operation of size bytes may join the batch.  An
+// empty batch accepts any operation.
+func (b *txnBatch) fits(size int) bool {
+	if len(b.ops) == 0 {
+		return true
+	}
+	return len(b.ops) < maxTxnOps && b.size+size+txnFraming <= maxTxnSize
+}
+
+func (b *txnBatch) add(op *api.KVTxnOp, size int) {
+	b.ops = append(b.ops, op)
+	b.size += size
+}
+
+// take empties the batch, returning its operations.
+func (b *txnBatch) take() api.KVTxnOps {
+	ops := b.ops
+	b.ops, b.size = nil, 0
+	return ops
+}
+
+// txnError describes why Consul rolled back a transaction.
+func txnError(ops api.KVTxnOps, resp *api.KVTxnResponse) error {
+	var msgs []string
+	for _, e := range resp.Errors {
+		if e.OpIndex >= 0 && e.OpIndex < len(ops) {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", ops[e.OpIndex].Key, e.What))
+		} else {
+			msgs = append(msgs, e.What)
+		}
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, "unknown error")
+	}
+	return fmt.Errorf("consul transaction rolled back: %s", strings.Join(msgs, "; "))
+}
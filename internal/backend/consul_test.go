@@ -0,0 +1,335 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/vault/physical"
+)
+
+// fakeConsul serves the parts of the Consul KV API that ConsulSource and
+// ConsulSink use, and records the requests made of it.
+type fakeConsul struct {
+	mu  sync.Mutex
+	kv  map[string][]byte
+	srv *httptest.Server
+
+	// status, if set, is returned for every request.
+	status int
+	// listed, if set, is called after each key listing.
+	listed func()
+
+	tokens   []string
+	txnOps   []int
+	txnSizes []int
+	puts     []string
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	t.Helper()
+	c := &fakeConsul{kv: make(map[string][]byte)}
+	c.srv = httptest.NewServer(c)
+	return c
+}
+
+func (c *fakeConsul) Close() {
+	c.srv.Close()
+}
+
+func (c *fakeConsul) client(t *testing.T, token string) *api.Client {
+	t.Helper()
+	client, err := NewConsulClient(c.srv.URL, &Options{ConsulToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokens = append(c.tokens, r.Header.Get("X-Consul-Token"))
+	if c.status != 0 {
+		http.Error(w, "injected failure", c.status)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/txn" && r.Method == "PUT":
+		c.txn(w, body)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == "GET":
+		if _, ok := r.URL.Query()["keys"]; !ok {
+			http.Error(w, "only key listings are supported", http.StatusBadRequest)
+			return
+		}
+		c.keys(w, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == "PUT":
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		c.kv[key] = body
+		c.puts = append(c.puts, key)
+		fmt.Fprint(w, "true")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *fakeConsul) keys(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for k := range c.kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	if c.listed != nil {
+		c.listed()
+	}
+	if len(keys) == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	sort.Strings(keys)
+	json.NewEncoder(w).Encode(keys) // nolint: errcheck
+}
+
+// txn applies a transaction as Consul would: all of it, or none of it.
+func (c *fakeConsul) txn(w http.ResponseWriter, body []byte) {
+	c.txnOps = append(c.txnOps, 0)
+	c.txnSizes = append(c.txnSizes, len(body))
+	if len(body) > maxTxnSize {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var ops api.TxnOps
+	if err := json.Unmarshal(body, &ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.txnOps[len(c.txnOps)-1] = len(ops)
+	if len(ops) > maxTxnOps {
+		http.Error(w, "too many operations", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resp api.TxnResponse
+	for i, op := range ops {
+		if op.KV.Verb == api.KVGet {
+			if _, ok := c.kv[op.KV.Key]; !ok {
+				resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: fmt.Sprintf("key %q doesn't exist", op.KV.Key)})
+			}
+		}
+	}
+	if len(resp.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&resp) // nolint: errcheck
+		return
+	}
+
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case api.KVGet:
+			resp.Results = append(resp.Results, &api.TxnResult{KV: &api.KVPair{Key: op.KV.Key, Value: c.kv[op.KV.Key]}})
+		case api.KVSet:
+			c.kv[op.KV.Key] = op.KV.Value
+			resp.Results = append(resp.Results, &api.TxnResult{KV: &api.KVPair{Key: op.KV.Key}})
+		}
+	}
+	json.NewEncoder(w).Encode(&resp) // nolint: errcheck
+}
+
+// writeConsul copies entries into Consul beneath consulPath.
+func writeConsul(t *testing.T, client *api.Client, consulPath string, entries []*physical.Entry) {
+	t.Helper()
+	sink, err := OpenConsulSink(client, consulPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(context.Background(), sink, &sliceSource{entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkConsul reads every entry beneath consulPath and compares it with want.
+func checkConsul(t *testing.T, client *api.Client, consulPath string, want []*physical.Entry) {
+	t.Helper()
+	src, err := OpenConsulSource(context.Background(), client, consulPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+
+	got := &sliceSource{}
+	if _, err := Copy(context.Background(), &sliceSink{source: got}, src); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.entries) != len(want) {
+		t.Fatalf("read %d entries, want %d", len(got.entries), len(want))
+	}
+	for i, e := range got.entries {
+		if e.Key != want[i].Key || !bytes.Equal(e.Value, want[i].Value) {
+			t.Fatalf("entry %d: got %s, want %s", i, e.Key, want[i].Key)
+		}
+	}
+}
+
+// sliceSink appends every entry written to source.
+type sliceSink struct {
+	source *sliceSource
+}
+
+func (s *sliceSink) Close() error {
+	return nil
+}
+
+func (s *sliceSink) Checkpoint() (SinkPosition, error) {
+	return SinkPosition{}, nil
+}
+
+func (s *sliceSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	s.source.entries = append(s.source.entries, entry)
+	return nil
+}
+
+func TestConsulRoundTrip(t *testing.T) {
+	c := newFakeConsul(t)
+	defer c.Close()
+	client := c.client(t, "")
+	entries := testEntries(3*maxTxnOps + 8)
+
+	writeConsul(t, client, "vault", entries)
+	if want := []int{maxTxnOps, maxTxnOps, maxTxnOps, 8}; fmt.Sprint(c.txnOps) != fmt.Sprint(want) {
+		t.Errorf("got transactions of %v operations, want %v", c.txnOps, want)
+	}
+	if _, ok := c.kv["vault/"+entries[0].Key]; !ok {
+		t.Errorf("%s not written beneath the Consul path", entries[0].Key)
+	}
+
+	c.txnOps = nil
+	checkConsul(t, client, "vault", entries)
+	for _, n := range c.txnOps {
+		if n > maxTxnOps {
+			t.Errorf("read %d keys in one transaction, want at most %d", n, maxTxnOps)
+		}
+	}
+}
+
+func TestConsulSinkSizeLimit(t *testing.T) {
+	c := newFakeConsul(t)
+	defer c.Close()
+	client := c.client(t, "")
+
+	// Each value fits in a transaction, but not many to a transaction.
+	var entries []*physical.Entry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &physical.Entry{
+			Key:   fmt.Sprintf("logical/%05d", i),
+			Value: bytes.Repeat([]byte{byte(i)}, 100*1024),
+		})
+	}
+	// This value fits in Consul only as a plain PUT.
+	large := &physical.Entry{Key: "logical/large", Value: bytes.Repeat([]byte{'x'}, 400*1024)}
+	entries = append(entries, large)
+
+	writeConsul(t, client, "vault", entries)
+	if len(c.txnOps) < 3 {
+		t.Errorf("got %d transactions, want at least 3", len(c.txnOps))
+	}
+	for i, size := range c.txnSizes {
+		if size > maxTxnSize {
+			t.Errorf("transaction %d is %d bytes, want at most %d", i, size, maxTxnSize)
+		}
+	}
+	if want := []string{"vault/" + large.Key}; fmt.Sprint(c.puts) != fmt.Sprint(want) {
+		t.Errorf("got plain PUTs of %v, want %v", c.puts, want)
+	}
+	checkConsul(t, client, "vault", entries)
+}
+
+func TestConsulToken(t *testing.T) {
+	c := newFakeConsul(t)
+	defer c.Close()
+	client := c.client(t, "s3cr3t")
+
+	writeConsul(t, client, "vault", testEntries(3))
+	checkConsul(t, client, "vault", testEntries(3))
+	if len(c.tokens) == 0 {
+		t.Fatal("no requests made")
+	}
+	for i, token := range c.tokens {
+		if token != "s3cr3t" {
+			t.Errorf("request %d: got token %q, want %q", i, token, "s3cr3t")
+		}
+	}
+}
+
+func TestConsulSourceKeyRemoved(t *testing.T) {
+	c := newFakeConsul(t)
+	defer c.Close()
+	client := c.client(t, "")
+	entries := testEntries(5)
+	writeConsul(t, client, "vault", entries)
+
+	removed := "vault/" + entries[3].Key
+	c.listed = func() { delete(c.kv, removed) }
+	src, err := OpenConsulSource(context.Background(), client, "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Copy(context.Background(), &sliceSink{source: &sliceSource{}}, src)
+	if err == nil || !strings.Contains(err.Error(), removed) {
+		t.Errorf("got %v, want an error naming %s", err, removed)
+	}
+}
+
+func TestConsulErrors(t *testing.T) {
+	c := newFakeConsul(t)
+	defer c.Close()
+	client := c.client(t, "")
+	writeConsul(t, client, "vault", testEntries(3))
+	c.status = http.StatusInternalServerError
+
+	if _, err := OpenConsulSource(context.Background(), client, "vault"); err == nil {
+		t.Error("listing keys: no error")
+	}
+
+	sink, err := OpenConsulSink(client, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteEntry(context.Background(), &physical.Entry{Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err == nil {
+		t.Error("transaction: no error")
+	}
+
+	large := &physical.Entry{Key: "large", Value: bytes.Repeat([]byte{'x'}, 400*1024)}
+	if err := sink.WriteEntry(context.Background(), large); err == nil {
+		t.Error("plain PUT: no error")
+	}
+
+	if err := sink.WriteEntry(context.Background(), &physical.Entry{Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Checkpoint(); err == nil {
+		t.Error("checkpoint: no error")
+	}
+}
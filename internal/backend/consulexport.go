@@ -0,0 +1,353 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	consul "github.com/hashicorp/consul/command/kv/impexp"
+	"github.com/hashicorp/vault/physical"
+)
+
+// ConsulExportSource reads a JSON-serialised Consul KV tree.  Consul will
+// output KV data in this format with 'consul kv export'.
+type ConsulExportSource struct {
+	file      io.ReadCloser
+	decoder   *json.Decoder
+	keyPrefix string
+}
+
+func OpenConsulExportSource(backendPath, consulPath string) (*ConsulExportSource, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(backendPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ConsulExportSource{
+		file:      f,
+		decoder:   json.NewDecoder(f),
+		keyPrefix: keyPrefix,
+	}
+
+	if err := s.eatHeader(); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ConsulExportSource) Close() error {
+	return s.file.Close()
+}
+
+// ReadEntry skips entries outside of the Vault key prefix, and the folder
+// entries that Consul keeps for the prefix itself.
+func (s *ConsulExportSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !s.decoder.More() {
+			return nil, io.EOF
+		}
+
+		entry := &consul.Entry{}
+		if err := s.decoder.Decode(entry); err != nil {
+			return nil, err
+		}
+
+		if !KeyHasPrefix(entry.Key, s.keyPrefix) {
+			continue
+		}
+		key := KeyStripPrefix(entry.Key, s.keyPrefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+
+		v, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Key, err)
+		}
+		return &physical.Entry{Key: key, Value: v}, nil
+	}
+}
+
+// eatHeader positions a new file cursor at the start of the key-value object
+// sequence.
+func (s *ConsulExportSource) eatHeader() error {
+	t, err := s.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("expected JSON token: '[', got: %s", t)
+	}
+	return nil
+}
+
+// ConsulExportSink writes a JSON-serialised Consul KV tree.  The output may
+// be imported into a Consul KV store with 'consul kv import'.
+type ConsulExportSink struct {
+	file         *os.File
+	buffer       *bytes.Buffer
+	keyPrefix    string
+	maxValueSize int
+	// empty is set until the first entry is written.
+	empty bool
+}
+
+// OpenConsulExportSink creates backendPath.  Entries with values larger than
+// maxValueSize bytes are refused, as Consul would refuse to import them.  A
+// maxValueSize of zero or less is no limit.
+func OpenConsulExportSink(backendPath, consulPath string, maxValueSize int) (*ConsulExportSink, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(backendPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ConsulExportSink{
+		file:         f,
+		buffer:       &bytes.Buffer{},
+		keyPrefix:    keyPrefix,
+		maxValueSize: maxValueSize,
+		empty:        true,
+	}
+
+	if err := s.writeHeader(); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	return s, nil
+}
+
+// ResumeConsulExportSink reopens a partial export at backendPath, as left by
+// a Checkpoint at offset.  Anything written after offset is discarded.
+func ResumeConsulExportSink(backendPath, consulPath string, maxValueSize int, offset int64) (*ConsulExportSink, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(backendPath, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ConsulExportSink{
+		file:         f,
+		buffer:       &bytes.Buffer{},
+		keyPrefix:    keyPrefix,
+		maxValueSize: maxValueSize,
+	}
+
+	if err := s.reopen(offset); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, fmt.Errorf("%s: %v", backendPath, err)
+	}
+	return s, nil
+}
+
+func (s *ConsulExportSink) Close() error {
+	if err := s.writeTrailer(); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *ConsulExportSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	key := KeyAddPrefix(entry.Key, s.keyPrefix)
+	if err := checkValueSize(key, len(entry.Value), s.maxValueSize); err != nil {
+		return err
+	}
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	compacted, err := json.Marshal(&consul.Entry{
+		Key:   key,
+		Value: base64.StdEncoding.EncodeToString(entry.Value),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.buffer.WriteString("\t")
+	if err := json.Indent(s.buffer, compacted, "\t", "\t"); err != nil {
+		return err
+	}
+	s.buffer.WriteString(",\n")
+	s.empty = false
+	return nil
+}
+
+// Checkpoint writes out every entry so far.  The file then holds a JSON
+// array that is open at the end, which ResumeConsulExportSink continues.
+// The last element's separator stays in the buffer, so that writeTrailer
+// can still remove it.
+func (s *ConsulExportSink) Checkpoint() (SinkPosition, error) {
+	sep := bytes.HasSuffix(s.buffer.Bytes(), []byte(",\n"))
+	if sep {
+		s.buffer.Truncate(s.buffer.Len() - 2)
+	}
+	if err := s.flush(); err != nil {
+		return SinkPosition{}, err
+	}
+	if sep {
+		s.buffer.WriteString(",\n")
+	}
+	if err := s.file.Sync(); err != nil {
+		return SinkPosition{}, err
+	}
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return SinkPosition{}, err
+	}
+	return SinkPosition{Offset: offset}, nil
+}
+
+// reopen truncates the file to offset, which must fall at the end of the
+// header or of a complete element.  After an element, its separator is
+// restored to the buffer.
+func (s *ConsulExportSink) reopen(offset int64) error {
+	head := make([]byte, 1)
+	if _, err := s.file.ReadAt(head, 0); err != nil || head[0] != '[' {
+		return errors.New("not a partial Consul KV export")
+	}
+	if offset < 2 {
+		return fmt.Errorf("invalid checkpoint offset %d", offset)
+	}
+	tail := make([]byte, 2)
+	if _, err := s.file.ReadAt(tail, offset-2); err != nil {
+		return fmt.Errorf("shorter than checkpoint offset %d", offset)
+	}
+
+	switch {
+	case offset == 2 && string(tail) == "[\n":
+		s.empty = true
+	case tail[1] == '}':
+		s.buffer.WriteString(",\n")
+	default:
+		return fmt.Errorf("no complete element ends at checkpoint offset %d", offset)
+	}
+
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *ConsulExportSink) flush() error {
+	if s.buffer.Len() > 0 {
+		if _, err := s.buffer.WriteTo(s.file); err != nil {
+			return err
+		}
+		s.buffer.Reset()
+	}
+	return nil
+}
+
+func (s *ConsulExportSink) writeHeader() error {
+	s.buffer.WriteString("[\n")
+	return nil
+}
+
+func (s *ConsulExportSink) writeTrailer() error {
+	if s.empty {
+		s.buffer.WriteString("]\n")
+		return nil
+	}
+	// Remove trailing JSON element sequence separator and newline.
+	l := s.buffer.Len()
+	if l >= 2 {
+		s.buffer.Truncate(l - 2)
+	}
+	s.buffer.WriteString("\n]\n")
+	return nil
+}
+
+// cleanConsulPath returns the key prefix for a Consul path.  As in Vault, a
+// Consul path of / places Vault data at the top level of the KV store; its
+// key prefix is empty.
+func cleanConsulPath(consulPath string) (string, error) {
+	keyPrefix := path.Clean(consulPath)
+	if keyPrefix == "/" {
+		return "", nil
+	}
+	if keyPrefix == "." {
+		return "", fmt.Errorf("invalid Consul path: %v", consulPath)
+	}
+	return keyPrefix, nil
+}
+
+// KeyHasPrefix reports whether the path elements of key begin with those of
+// prefix.  Every key has the empty prefix.
+func KeyHasPrefix(key, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	ke := strings.Split(key, "/")
+	pe := strings.Split(prefix, "/")
+	if len(ke) < len(pe) {
+		return false
+	}
+	for i := range pe {
+		if ke[i] != pe[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyStripPrefix removes the path elements of prefix from key.  key is
+// returned unchanged if it does not begin with prefix.
+func KeyStripPrefix(key, prefix string) string {
+	if prefix == "" {
+		return key
+	}
+	ke := strings.Split(key, "/")
+	pe := strings.Split(prefix, "/")
+	if len(ke) < len(pe) {
+		return strings.Join(ke, "/")
+	}
+	for i := range pe {
+		if ke[i] != pe[i] {
+			return strings.Join(ke, "/")
+		}
+	}
+	return strings.Join(ke[len(pe):], "/")
+}
+
+// KeyAddPrefix prepends the path elements of prefix to key.
+func KeyAddPrefix(key, prefix string) string {
+	if prefix == "" {
+		return key
+	}
+	pe := strings.Split(prefix, "/")
+	ke := strings.Split(key, "/")
+	elems := make([]string, 0, len(pe)+len(ke))
+	elems = append(elems, pe...)
+	elems = append(elems, ke...)
+	return strings.Join(elems, "/")
+}
@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func keysOf(src *sliceSource) []string {
+	var keys []string
+	for _, e := range src.entries {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+// writeExport copies entries to a new sink, and closes it.
+func writeExport(t *testing.T, dst Sink, src Source) {
+	t.Helper()
+	if _, err := Copy(context.Background(), dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulExportRoundTrip(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.json")
+	src := &sliceSource{entries: testEntries(100)}
+
+	sink, err := OpenConsulExportSink(path, "clusters/a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeExport(t, sink, src)
+
+	var exported []struct{ Key string }
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 100 || exported[0].Key != "clusters/a/logical/00000" {
+		t.Errorf("got %d keys, first %+v", len(exported), exported[0])
+	}
+
+	source, err := OpenConsulExportSource(path, "clusters/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close() // nolint: errcheck
+	if got, want := readAll(t, source), keysOf(src); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestConsulExportSinkEmpty(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.json")
+
+	sink, err := OpenConsulExportSink(path, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeExport(t, sink, &sliceSource{})
+	split, err := OpenSplitConsulExportSink(path, "vault", 0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeExport(t, split, &sliceSource{})
+
+	for _, p := range []string{path, SplitPath(path, 1)} {
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exported []interface{}
+		if err := json.Unmarshal(buf, &exported); err != nil {
+			t.Errorf("%s: %v: %q", filepath.Base(p), err, buf)
+		}
+		if len(exported) != 0 {
+			t.Errorf("%s: got %d entries", filepath.Base(p), len(exported))
+		}
+	}
+}
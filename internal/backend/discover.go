@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	consul "github.com/hashicorp/consul/command/kv/impexp"
+)
+
+// Keys that every initialised Vault root holds.
+var vaultRootMarkers = []string{"core/keyring", "core/seal-config"}
+
+// TopLevelPrefix is the Consul path of a Vault root at the top level of the
+// KV store.
+const TopLevelPrefix = "/"
+
+// VaultRoot is a Consul key prefix beneath which a Vault cluster stores its
+// data.
+type VaultRoot struct {
+	// Prefix is a Consul path; TopLevelPrefix for the top level.
+	Prefix  string
+	Entries int
+}
+
+// keyPrefix returns the key prefix of r.
+func (r VaultRoot) keyPrefix() string {
+	if r.Prefix == TopLevelPrefix {
+		return ""
+	}
+	return r.Prefix
+}
+
+// DiscoverVaultRoots finds the prefixes among keys that look like Vault
+// roots: those with both core/keyring and core/seal-config beneath them.
+// Each key is counted towards the longest root that contains it.  Folder
+// keys are not counted.  Roots are returned sorted by prefix.
+func DiscoverVaultRoots(keys []string) []VaultRoot {
+	markers := make(map[string]int)
+	for _, k := range keys {
+		for _, m := range vaultRootMarkers {
+			switch {
+			case k == m:
+				markers[TopLevelPrefix]++
+			case strings.HasSuffix(k, "/"+m):
+				markers[strings.TrimSuffix(k, "/"+m)]++
+			}
+		}
+	}
+
+	var roots []VaultRoot
+	for p, n := range markers {
+		if n == len(vaultRootMarkers) {
+			roots = append(roots, VaultRoot{Prefix: p})
+		}
+	}
+	// Longer prefixes first, so that nested roots claim their own keys.
+	sort.Slice(roots, func(i, j int) bool { return len(roots[i].keyPrefix()) > len(roots[j].keyPrefix()) })
+
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		for i := range roots {
+			if KeyHasPrefix(k, roots[i].keyPrefix()) && k != roots[i].keyPrefix() {
+				roots[i].Entries++
+				break
+			}
+		}
+	}
+
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Prefix < roots[j].Prefix })
+	return roots
+}
+
+// NestedRootPatterns returns Filter patterns that exclude, from the Vault
+// keys of root, the data of every other root nested beneath it.
+func NestedRootPatterns(root VaultRoot, roots []VaultRoot) []string {
+	var patterns []string
+	for _, r := range roots {
+		if r.Prefix == root.Prefix || r.Prefix == TopLevelPrefix || !KeyHasPrefix(r.keyPrefix(), root.keyPrefix()) {
+			continue
+		}
+		patterns = append(patterns, KeyStripPrefix(r.keyPrefix(), root.keyPrefix())+"/*")
+	}
+	return patterns
+}
+
+// ListConsulKeys returns every key of the Consul KV tree named by spec,
+// regardless of the Consul path.  Only the consul and consul-export schemes
+// are supported.
+func ListConsulKeys(ctx context.Context, spec string, opts *Options) ([]string, error) {
+	scheme, addr, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	switch scheme {
+	case SchemeConsul:
+		client, err := NewConsulClient(addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		q := (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx)
+		keys, _, err := client.KV().Keys("", "", q)
+		return keys, err
+
+	case SchemeConsulExport:
+		if !isSplitExport(addr) {
+			return exportKeys(addr)
+		}
+		var keys []string
+		for i := 1; ; i++ {
+			k, err := exportKeys(SplitPath(addr, i))
+			if os.IsNotExist(err) && i > 1 {
+				return keys, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k...)
+		}
+
+	default:
+		return nil, fmt.Errorf("%s: not a Consul KV tree", spec)
+	}
+}
+
+// exportKeys returns the keys of a JSON-serialised Consul KV tree.
+func exportKeys(backendPath string) ([]string, error) {
+	f, err := os.Open(backendPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	decoder := json.NewDecoder(f)
+	t, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		return nil, fmt.Errorf("expected JSON token: '[', got: %s", t)
+	}
+
+	var keys []string
+	for decoder.More() {
+		entry := &consul.Entry{}
+		if err := decoder.Decode(entry); err != nil {
+			return nil, err
+		}
+		keys = append(keys, entry.Key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverVaultRoots(t *testing.T) {
+	keys := []string{
+		"core/keyring",
+		"core/seal-config",
+		"logical/top",
+		"a/",
+		"a/core/keyring",
+		"a/core/seal-config",
+		"a/logical/x",
+		"a/b/core/keyring",
+		"a/b/core/seal-config",
+		"a/b/logical/y",
+		"a/b/logical/z",
+		"c/core/keyring",
+		"c/logical/w",
+	}
+	got := DiscoverVaultRoots(keys)
+	want := []VaultRoot{
+		{Prefix: TopLevelPrefix, Entries: 5},
+		{Prefix: "a", Entries: 3},
+		{Prefix: "a/b", Entries: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, c := range []struct {
+		root VaultRoot
+		want []string
+	}{
+		{got[0], []string{"a/*", "a/b/*"}},
+		{got[1], []string{"b/*"}},
+		{got[2], nil},
+	} {
+		if patterns := NestedRootPatterns(c.root, got); !reflect.DeepEqual(patterns, c.want) {
+			t.Errorf("%s: got %v, want %v", c.root.Prefix, patterns, c.want)
+		}
+	}
+}
+
+func TestKeyPrefixes(t *testing.T) {
+	for _, c := range []struct {
+		key, prefix string
+		has         bool
+		stripped    string
+	}{
+		{"vault/core/keyring", "vault", true, "core/keyring"},
+		{"vaultx/core/keyring", "vault", false, "vaultx/core/keyring"},
+		{"a/b/c", "a/b", true, "c"},
+		{"core/keyring", "", true, "core/keyring"},
+	} {
+		if got := KeyHasPrefix(c.key, c.prefix); got != c.has {
+			t.Errorf("KeyHasPrefix(%q, %q) = %v", c.key, c.prefix, got)
+		}
+		if got := KeyStripPrefix(c.key, c.prefix); got != c.stripped {
+			t.Errorf("KeyStripPrefix(%q, %q) = %q", c.key, c.prefix, got)
+		}
+		if c.has {
+			if got := KeyAddPrefix(c.stripped, c.prefix); got != c.key {
+				t.Errorf("KeyAddPrefix(%q, %q) = %q", c.stripped, c.prefix, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/physical"
+	glob "github.com/ryanuber/go-glob"
+)
+
+// HAKeys match the entries Vault keeps for leader election and cluster
+// membership.  They describe the servers of the old cluster and should not
+// be carried over to a new one.
+var HAKeys = []string{
+	"core/lock",
+	"core/leader/*",
+	"core/poison-pill",
+	"core/primary-addrs/*",
+	"core/cluster/local/info",
+}
+
+// Filter selects keys by glob.  * matches any sequence of characters,
+// including /.
+type Filter struct {
+	// Include lists the patterns of keys to keep.  If empty, every key
+	// not excluded is kept.
+	Include []string
+	// Exclude lists the patterns of keys to drop.  Exclusion takes
+	// precedence over inclusion.
+	Exclude []string
+}
+
+// Match reports whether key is selected by f.  A nil filter selects every
+// key.
+func (f *Filter) Match(key string) bool {
+	if f == nil {
+		return true
+	}
+	for _, p := range f.Exclude {
+		if glob.Glob(p, key) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, p := range f.Include {
+		if glob.Glob(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterSource returns a source that yields only the entries of src selected
+// by f.
+func FilterSource(src Source, f *Filter) Source {
+	if f == nil || (len(f.Include) == 0 && len(f.Exclude) == 0) {
+		return src
+	}
+	return &filterSource{Source: src, filter: f}
+}
+
+type filterSource struct {
+	Source
+	filter *Filter
+}
+
+func (s *filterSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	for {
+		entry, err := s.Source.ReadEntry(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.filter.Match(entry.Key) {
+			return entry, nil
+		}
+	}
+}
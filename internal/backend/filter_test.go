@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestFilterMatch(t *testing.T) {
+	f := &Filter{
+		Include: []string{"logical/*", "core/*"},
+		Exclude: append([]string{"logical/*/secret"}, HAKeys...),
+	}
+	for key, want := range map[string]bool{
+		"logical/a/b":      true,
+		"logical/a/secret": false,
+		"core/keyring":     true,
+		"core/lock":        false,
+		"core/leader/abc":  false,
+		"sys/token/id/abc": false,
+		"logicalish/a":     false,
+	} {
+		if got := f.Match(key); got != want {
+			t.Errorf("%s: got %v, want %v", key, got, want)
+		}
+	}
+
+	var none *Filter
+	if !none.Match("anything") {
+		t.Error("nil filter did not match")
+	}
+}
+
+func TestFilterSource(t *testing.T) {
+	src := &sliceSource{entries: testEntries(20)}
+	f := &Filter{Include: []string{"logical/0000*"}, Exclude: []string{"logical/00003"}}
+
+	got := readAll(t, FilterSource(src, f))
+	want := []string{"logical/00000", "logical/00001", "logical/00002", "logical/00004", "logical/00005",
+		"logical/00006", "logical/00007", "logical/00008", "logical/00009"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFilterFlags(t *testing.T) {
+	for args, want := range map[string]int{
+		"":                                0,
+		"--exclude-ha-keys":               len(HAKeys),
+		"--no-exclude-ha-keys":            0,
+		"--exclude=a/*":                   1,
+		"--exclude=a/* --exclude-ha-keys": len(HAKeys) + 1,
+	} {
+		app := kingpin.New("test", "")
+		f := &Filter{}
+		FilterFlags(app, f)
+		if _, err := app.Parse(strings.Fields(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		if len(f.Exclude) != want {
+			t.Errorf("%q: got exclusions %q, want %d", args, f.Exclude, want)
+		}
+	}
+}
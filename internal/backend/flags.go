@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"strconv"
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ConsulFlags registers the flags that configure a connection to a live
+// Consul agent.  Parsed values are stored in opts.
+func ConsulFlags(app *kingpin.Application, opts *Options) {
+	app.Flag("consul-token",
+		"ACL token for a live Consul agent.  Defaults to $CONSUL_HTTP_TOKEN.").
+		PlaceHolder("TOKEN").StringVar(&opts.ConsulToken)
+	app.Flag("consul-ca-file",
+		"CA certificate used to verify a live Consul agent.  Defaults to $CONSUL_CACERT.").
+		PlaceHolder("FILE").StringVar(&opts.ConsulTLS.CAFile)
+	app.Flag("consul-ca-path",
+		"Directory of CA certificates used to verify a live Consul agent.  Defaults to $CONSUL_CAPATH.").
+		PlaceHolder("DIR").StringVar(&opts.ConsulTLS.CAPath)
+	app.Flag("consul-client-cert",
+		"Client certificate presented to a live Consul agent.  Defaults to $CONSUL_CLIENT_CERT.").
+		PlaceHolder("FILE").StringVar(&opts.ConsulTLS.CertFile)
+	app.Flag("consul-client-key",
+		"Private key for --consul-client-cert.  Defaults to $CONSUL_CLIENT_KEY.").
+		PlaceHolder("FILE").StringVar(&opts.ConsulTLS.KeyFile)
+	app.Flag("consul-tls-server-name",
+		"Server name used to verify a live Consul agent's certificate.  Defaults to $CONSUL_TLS_SERVER_NAME.").
+		PlaceHolder("NAME").StringVar(&opts.ConsulTLS.Address)
+	app.Flag("consul-tls-skip-verify",
+		"Do not verify a live Consul agent's certificate.").
+		BoolVar(&opts.ConsulTLS.InsecureSkipVerify)
+}
+
+// FilterFlags registers the flags that select which source keys are copied
+// or compared.  Parsed values are stored in f.
+func FilterFlags(app *kingpin.Application, f *Filter) {
+	app.Flag("include",
+		"Select only source keys that match GLOB.  * matches any sequence of characters, including /.  May be repeated.").
+		PlaceHolder("GLOB").StringsVar(&f.Include)
+	app.Flag("exclude",
+		"Skip source keys that match GLOB.  Takes precedence over --include.  May be repeated.").
+		PlaceHolder("GLOB").StringsVar(&f.Exclude)
+	var excludeHAKeys bool
+	app.Flag("exclude-ha-keys",
+		"Skip the keys Vault uses for leader election and cluster membership: "+strings.Join(HAKeys, ", ")+".  These confuse a server that is not part of the old cluster.").
+		Action(func(*kingpin.ParseContext) error {
+			// The action also runs for --no-exclude-ha-keys.
+			if excludeHAKeys {
+				f.Exclude = append(f.Exclude, HAKeys...)
+			}
+			return nil
+		}).
+		BoolVar(&excludeHAKeys)
+}
+
+// ConsulLimitFlags registers the flags that bound what is written to Consul
+// or to a Consul export.  Parsed values are stored in opts.
+func ConsulLimitFlags(app *kingpin.Application, opts *Options) {
+	app.Flag("max-value-size",
+		"Refuse to write values larger than BYTES, which Consul would reject.  Match the kv_max_value_size of the target cluster.  0 disables the check.").
+		Default(strconv.Itoa(DefaultConsulMaxValueSize)).PlaceHolder("BYTES").IntVar(&opts.ConsulMaxValueSize)
+	app.Flag("split-size",
+		"Split a Consul export into a series of files of about BYTES each, named like OUTPUT-001.json, OUTPUT-002.json and so on.  Each file may be imported with 'consul kv import' on its own.").
+		PlaceHolder("BYTES").IntVar(&opts.ConsulSplitSize)
+}
@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+// jsonlEntry is a single line of the JSON-lines format.  encoding/json
+// encodes Value as base64.
+type jsonlEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// maxJSONLLine bounds the length of a single line.  Vault entries are
+// rarely larger than Consul's 512 KiB value limit.
+const maxJSONLLine = 64 * 1024 * 1024
+
+// JSONLSource reads the portable JSON-lines format: one object per line,
+// with key and base64-encoded value fields.
+type JSONLSource struct {
+	file    io.ReadCloser
+	scanner *bufio.Scanner
+	line    int
+}
+
+// OpenJSONLSource opens backendPath, or standard input if backendPath is -.
+func OpenJSONLSource(backendPath string) (*JSONLSource, error) {
+	var f io.ReadCloser = os.Stdin
+	if backendPath != "-" {
+		var err error
+		f, err = os.Open(backendPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), maxJSONLLine)
+	return &JSONLSource{file: f, scanner: s}, nil
+}
+
+func (s *JSONLSource) Close() error {
+	return s.file.Close()
+}
+
+func (s *JSONLSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for s.scanner.Scan() {
+		s.line++
+		if len(s.scanner.Bytes()) == 0 {
+			continue
+		}
+		e := &jsonlEntry{}
+		if err := json.Unmarshal(s.scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", s.line, err)
+		}
+		if e.Key == "" {
+			return nil, fmt.Errorf("line %d: missing key", s.line)
+		}
+		return &physical.Entry{Key: e.Key, Value: e.Value}, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// JSONLSink writes the portable JSON-lines format.
+type JSONLSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// OpenJSONLSink creates backendPath, or writes to standard output if
+// backendPath is -.
+func OpenJSONLSink(backendPath string) (*JSONLSink, error) {
+	f := os.Stdout
+	if backendPath != "-" {
+		var err error
+		f, err = os.OpenFile(backendPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &JSONLSink{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+// ResumeJSONLSink reopens backendPath after a Checkpoint at offset.
+// Anything written after offset is discarded.
+func ResumeJSONLSink(backendPath string, offset int64) (*JSONLSink, error) {
+	if backendPath == "-" {
+		return nil, errors.New("cannot resume writing to standard output")
+	}
+	f, err := os.OpenFile(backendPath, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	if fi.Size() < offset {
+		f.Close() // nolint: errcheck
+		return nil, fmt.Errorf("%s: shorter than checkpoint offset %d", backendPath, offset)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &JSONLSink{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Checkpoint writes out every line so far.  Standard output cannot be
+// checkpointed.
+func (s *JSONLSink) Checkpoint() (SinkPosition, error) {
+	if s.file == os.Stdout {
+		return SinkPosition{}, errors.New("cannot checkpoint standard output")
+	}
+	if err := s.w.Flush(); err != nil {
+		return SinkPosition{}, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return SinkPosition{}, err
+	}
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return SinkPosition{}, err
+	}
+	return SinkPosition{Offset: offset}, nil
+}
+
+func (s *JSONLSink) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.file.Close() // nolint: errcheck
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *JSONLSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	buf, err := json.Marshal(&jsonlEntry{Key: entry.Key, Value: entry.Value})
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
@@ -0,0 +1,268 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/physical/file"
+	"github.com/hashicorp/vault/physical/inmem"
+)
+
+// NewFileBackend opens a Vault filesystem storage backend.
+func NewFileBackend(backendPath string, logger hclog.Logger) (physical.Backend, error) {
+	conf := map[string]string{"path": backendPath}
+
+	return file.NewFileBackend(conf, logger)
+}
+
+var (
+	inmemLock     sync.Mutex
+	inmemBackends = make(map[string]physical.Backend)
+)
+
+// inmemBackend returns the in-memory backend registered under name,
+// creating it if necessary.
+func inmemBackend(name string, logger hclog.Logger) physical.Backend {
+	inmemLock.Lock()
+	defer inmemLock.Unlock()
+
+	if b, ok := inmemBackends[name]; ok {
+		return b
+	}
+	// NewInmem never fails.
+	b, _ := inmem.NewInmem(nil, logger)
+	inmemBackends[name] = b
+	return b
+}
+
+// DefaultParallel is the default bound on concurrent operations against a
+// physical backend.
+const DefaultParallel = 16
+
+// PhysicalSource reads every entry of a physical backend in lexical key
+// order.  Directories are listed and entries are read ahead by a bounded
+// pool of workers; entries are still returned in order.
+type PhysicalSource struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	results chan chan readResult
+}
+
+type readResult struct {
+	entry *physical.Entry
+	err   error
+}
+
+type readJob struct {
+	key    string
+	result chan readResult
+}
+
+// NewPhysicalSource starts reading backend.  No more than parallel List and
+// Get operations are outstanding at once; if parallel is less than one,
+// DefaultParallel is used.
+func NewPhysicalSource(ctx context.Context, backend physical.Backend, parallel int) *PhysicalSource {
+	if parallel < 1 {
+		parallel = DefaultParallel
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &PhysicalSource{
+		ctx:     ctx,
+		cancel:  cancel,
+		results: make(chan chan readResult, 2*parallel),
+	}
+	w := &walker{
+		backend: backend,
+		pool:    physical.NewPermitPool(parallel),
+		ahead:   parallel,
+	}
+
+	jobs := make(chan readJob)
+	for i := 0; i < parallel; i++ {
+		go w.read(ctx, jobs)
+	}
+
+	go func() {
+		defer close(s.results)
+		defer close(jobs)
+
+		err := w.walk(ctx, "", w.list(ctx, ""), func(key string) error {
+			result := make(chan readResult, 1)
+			select {
+			case s.results <- result:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			select {
+			case jobs <- readJob{key: key, result: result}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			result := make(chan readResult, 1)
+			result <- readResult{err: err}
+			select {
+			case s.results <- result:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return s
+}
+
+// Close stops any outstanding reads.
+func (s *PhysicalSource) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *PhysicalSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	var (
+		result chan readResult
+		ok     bool
+	)
+	select {
+	case result, ok = <-s.results:
+		// The walker also stops early if cancelled.
+		if !ok && s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		if !ok {
+			return nil, io.EOF
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r := <-result:
+		return r.entry, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// PhysicalSink writes entries to a physical backend.
+type PhysicalSink struct {
+	backend physical.Backend
+}
+
+func NewPhysicalSink(backend physical.Backend) *PhysicalSink {
+	return &PhysicalSink{backend: backend}
+}
+
+func (s *PhysicalSink) Close() error {
+	return nil
+}
+
+// Checkpoint does nothing; every entry is written as it arrives.
+func (s *PhysicalSink) Checkpoint() (SinkPosition, error) {
+	return SinkPosition{}, nil
+}
+
+func (s *PhysicalSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	return s.backend.Put(ctx, entry)
+}
+
+// walker lists a physical backend depth-first in lexical key order.  Up to
+// ahead subdirectories of each directory are listed concurrently, ahead of
+// the walk, so that memory use does not grow with the width of a directory.
+type walker struct {
+	backend physical.Backend
+	pool    *physical.PermitPool
+	ahead   int
+}
+
+type listing struct {
+	done chan struct{}
+	keys []string
+	err  error
+}
+
+func (w *walker) list(ctx context.Context, prefix string) *listing {
+	l := &listing{done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+
+		w.pool.Acquire()
+		keys, err := w.backend.List(ctx, prefix)
+		w.pool.Release()
+
+		sort.Strings(keys)
+		l.keys, l.err = keys, err
+	}()
+	return l
+}
+
+func (w *walker) walk(ctx context.Context, prefix string, l *listing, fn func(key string) error) error {
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	var subdirs []string
+	for _, k := range l.keys {
+		if strings.HasSuffix(k, "/") {
+			subdirs = append(subdirs, k)
+		}
+	}
+	// Listings of subdirs[walked:started] are in flight.
+	var (
+		pending         []*listing
+		walked, started int
+	)
+	listAhead := func() {
+		for started < len(subdirs) && started-walked < w.ahead {
+			pending = append(pending, w.list(ctx, prefix+subdirs[started]))
+			started++
+		}
+	}
+	listAhead()
+
+	for _, k := range l.keys {
+		if strings.HasSuffix(k, "/") {
+			sub := pending[0]
+			pending = pending[1:]
+			walked++
+			listAhead()
+			if err := w.walk(ctx, prefix+k, sub, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(prefix + k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read fetches the entries named by jobs.
+func (w *walker) read(ctx context.Context, jobs <-chan readJob) {
+	for job := range jobs {
+		w.pool.Acquire()
+		entry, err := w.backend.Get(ctx, job.key)
+		w.pool.Release()
+
+		// The backend should be quiesced.
+		if err == nil && entry == nil {
+			err = fmt.Errorf("%s: removed while being read", job.key)
+		}
+		job.result <- readResult{entry: entry, err: err}
+	}
+}
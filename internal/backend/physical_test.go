@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/physical/inmem"
+)
+
+// newTestBackend returns an in-memory backend holding keys, each with its
+// own name as its value.
+func newTestBackend(t *testing.T, keys ...string) physical.Backend {
+	t.Helper()
+	b, err := inmem.NewInmem(nil, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := b.Put(context.Background(), &physical.Entry{Key: k, Value: []byte(k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// readAll returns the keys of every entry read from src.
+func readAll(t *testing.T, src Source) []string {
+	t.Helper()
+	var keys []string
+	for {
+		entry, err := src.ReadEntry(context.Background())
+		if err == io.EOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Value) != entry.Key {
+			t.Fatalf("%s: got value %q", entry.Key, entry.Value)
+		}
+		keys = append(keys, entry.Key)
+	}
+}
+
+func TestPhysicalSourceOrder(t *testing.T) {
+	keys := []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "c", "core/keyring", "d/e/f/g"}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("sys/expire/id/%03d/lease", i))
+	}
+	sort.Strings(keys)
+
+	for _, parallel := range []int{1, 4, DefaultParallel} {
+		src := NewPhysicalSource(context.Background(), newTestBackend(t, keys...), parallel)
+		got := readAll(t, src)
+		src.Close() // nolint: errcheck
+		if !reflect.DeepEqual(got, keys) {
+			t.Errorf("parallel %d: got %v, want %v", parallel, got, keys)
+		}
+	}
+}
+
+func TestPhysicalSourceCancel(t *testing.T) {
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("k/%04d", i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	src := NewPhysicalSource(ctx, newTestBackend(t, keys...), 4)
+	defer src.Close() // nolint: errcheck
+
+	if _, err := src.ReadEntry(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// Entries already read ahead may still be returned, but never io.EOF.
+	for i := 0; i < len(keys); i++ {
+		_, err := src.ReadEntry(context.Background())
+		if err == io.EOF {
+			t.Fatal("got io.EOF after cancel")
+		}
+		if err != nil {
+			if err != context.Canceled {
+				t.Fatalf("got %v, want %v", err, context.Canceled)
+			}
+			return
+		}
+	}
+	t.Fatal("read every entry after cancel")
+}
+
+// countingBackend counts List calls.
+type countingBackend struct {
+	physical.Backend
+	lists int64
+}
+
+func (b *countingBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	atomic.AddInt64(&b.lists, 1)
+	return b.Backend.List(ctx, prefix)
+}
+
+func TestPhysicalSourceListsAhead(t *testing.T) {
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("sys/expire/id/%04d/lease", i))
+	}
+	b := &countingBackend{Backend: newTestBackend(t, keys...)}
+	src := NewPhysicalSource(context.Background(), b, 2)
+	defer src.Close() // nolint: errcheck
+
+	if _, err := src.ReadEntry(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Let the walker run as far ahead as it will.
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&b.lists); n > 50 {
+		t.Errorf("%d directories listed after reading one entry", n)
+	}
+
+	if got := readAll(t, src); len(got) != len(keys)-1 {
+		t.Errorf("read %d more entries, want %d", len(got), len(keys)-1)
+	}
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// DefaultConsulMaxValueSize is the largest value Consul accepts by default.
+// See the kv_max_value_size option of the Consul agent.
+const DefaultConsulMaxValueSize = 512 * 1024
+
+// Oversize describes an entry whose value exceeds a size limit.
+type Oversize struct {
+	Key  string
+	Size int
+}
+
+// CheckSizes reads every entry of src and returns those whose values are
+// larger than limit bytes.  The number of entries read is returned
+// alongside.
+func CheckSizes(ctx context.Context, src Source, limit int) (n int, oversize []Oversize, err error) {
+	for {
+		entry, err := src.ReadEntry(ctx)
+		if err == io.EOF {
+			return n, oversize, nil
+		}
+		if err != nil {
+			return n, nil, err
+		}
+		n++
+		if len(entry.Value) > limit {
+			oversize = append(oversize, Oversize{Key: entry.Key, Size: len(entry.Value)})
+		}
+	}
+}
+
+// checkValueSize returns an error if a value of size bytes stored at key
+// would exceed limit.  A limit of zero or less is no limit.
+func checkValueSize(key string, size, limit int) error {
+	if limit > 0 && size > limit {
+		return fmt.Errorf("%s: value of %d bytes exceeds the Consul limit of %d bytes", key, size, limit)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+// exportEntryOverhead approximates the JSON framing of one entry in an
+// export, excluding the key and the encoded value.
+const exportEntryOverhead = 48
+
+// SplitPath returns the name of file i, counting from 1, of a split export
+// written to backendPath.  For example, vault.json becomes vault-001.json.
+func SplitPath(backendPath string, i int) string {
+	ext := filepath.Ext(backendPath)
+	return fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(backendPath, ext), i, ext)
+}
+
+// SplitConsulExportSink writes a series of JSON-serialised Consul KV trees,
+// each of about splitSize bytes or less.  Every file is a complete export
+// that may be imported with 'consul kv import' on its own.  An entry larger
+// than splitSize is written to a file by itself.
+type SplitConsulExportSink struct {
+	backendPath  string
+	consulPath   string
+	maxValueSize int
+	splitSize    int
+
+	sink  *ConsulExportSink
+	files int
+	size  int
+}
+
+func OpenSplitConsulExportSink(backendPath, consulPath string, maxValueSize, splitSize int) (*SplitConsulExportSink, error) {
+	s := &SplitConsulExportSink{
+		backendPath:  backendPath,
+		consulPath:   consulPath,
+		maxValueSize: maxValueSize,
+		splitSize:    splitSize,
+	}
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ResumeSplitConsulExportSink reopens a partial series at pos, as left by a
+// Checkpoint.  Files of the series after pos.File are removed.
+func ResumeSplitConsulExportSink(backendPath, consulPath string, maxValueSize, splitSize int, pos SinkPosition) (*SplitConsulExportSink, error) {
+	if pos.File < 1 {
+		return nil, fmt.Errorf("invalid checkpoint file %d", pos.File)
+	}
+	for i := pos.File + 1; ; i++ {
+		err := os.Remove(SplitPath(backendPath, i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sink, err := ResumeConsulExportSink(SplitPath(backendPath, pos.File), consulPath, maxValueSize, pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &SplitConsulExportSink{
+		backendPath:  backendPath,
+		consulPath:   consulPath,
+		maxValueSize: maxValueSize,
+		splitSize:    splitSize,
+		sink:         sink,
+		files:        pos.File,
+		size:         int(pos.Offset),
+	}, nil
+}
+
+func (s *SplitConsulExportSink) Close() error {
+	return s.sink.Close()
+}
+
+func (s *SplitConsulExportSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	size := len(s.sink.keyPrefix) + 1 + len(entry.Key) +
+		base64.StdEncoding.EncodedLen(len(entry.Value)) + exportEntryOverhead
+
+	if s.size > 0 && s.size+size > s.splitSize {
+		if err := s.sink.Close(); err != nil {
+			return err
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+	if err := s.sink.WriteEntry(ctx, entry); err != nil {
+		return err
+	}
+	s.size += size
+	return nil
+}
+
+func (s *SplitConsulExportSink) Checkpoint() (SinkPosition, error) {
+	pos, err := s.sink.Checkpoint()
+	if err != nil {
+		return SinkPosition{}, err
+	}
+	pos.File = s.files
+	return pos, nil
+}
+
+// next starts the following file of the series.
+func (s *SplitConsulExportSink) next() error {
+	sink, err := OpenConsulExportSink(SplitPath(s.backendPath, s.files+1), s.consulPath, s.maxValueSize)
+	if err != nil {
+		return err
+	}
+	s.sink = sink
+	s.files++
+	s.size = 0
+	return nil
+}
+
+// isSplitExport reports whether backendPath names a split export: the
+// file itself does not exist, but the first file of the series does.
+func isSplitExport(backendPath string) bool {
+	if _, err := os.Stat(backendPath); !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Stat(SplitPath(backendPath, 1))
+	return err == nil
+}
+
+// SplitConsulExportSource reads a series of exports written by
+// SplitConsulExportSink, in order, until the next file of the series does
+// not exist.
+type SplitConsulExportSource struct {
+	backendPath string
+	consulPath  string
+
+	source *ConsulExportSource
+	files  int
+}
+
+// OpenSplitConsulExportSource opens the first file of the series.
+func OpenSplitConsulExportSource(backendPath, consulPath string) (*SplitConsulExportSource, error) {
+	source, err := OpenConsulExportSource(SplitPath(backendPath, 1), consulPath)
+	if err != nil {
+		return nil, err
+	}
+	return &SplitConsulExportSource{
+		backendPath: backendPath,
+		consulPath:  consulPath,
+		source:      source,
+		files:       1,
+	}, nil
+}
+
+func (s *SplitConsulExportSource) Close() error {
+	if s.source == nil {
+		return nil
+	}
+	return s.source.Close()
+}
+
+func (s *SplitConsulExportSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for s.source != nil {
+		entry, err := s.source.ReadEntry(ctx)
+		if err != io.EOF {
+			return entry, err
+		}
+
+		if err := s.source.Close(); err != nil {
+			return nil, err
+		}
+		s.source = nil
+
+		source, err := OpenConsulExportSource(SplitPath(s.backendPath, s.files+1), s.consulPath)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.source = source
+		s.files++
+	}
+	return nil, io.EOF
+}
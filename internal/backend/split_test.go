@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+func TestSplitConsulExportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.json")
+
+	entries := testEntries(100)
+	large := &physical.Entry{Key: "logical/large", Value: bytes.Repeat([]byte{'x'}, 4096)}
+	entries = append(entries, large)
+
+	sink, err := OpenSink(ctx, "consul-export:"+path, &Options{ConsulSplitSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file is an export of its own, and the large entry has a file to
+	// itself.
+	var files int
+	var last []*physical.Entry
+	for i := 1; ; i++ {
+		src, err := OpenConsulExportSource(SplitPath(path, i), "vault")
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = readEntries(t, src)
+		src.Close() // nolint: errcheck
+		files++
+	}
+	if files < 3 {
+		t.Errorf("got %d files, want at least 3", files)
+	}
+	if len(last) != 1 || last[0].Key != large.Key {
+		t.Errorf("large entry shares its file with %d others", len(last)-1)
+	}
+
+	// The series is found in place of the named file.
+	src, err := OpenSource(ctx, "consul-export:"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
+
+func TestSplitConsulExportResume(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "vault.json")
+	entries := testEntries(100)
+
+	// Files started after the checkpoint are removed on resume.
+	sink, err := OpenSplitConsulExportSink(path, "vault", 0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[:30]}); err != nil {
+		t.Fatal(err)
+	}
+	pos, err := sink.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: testEntries(300)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err = ResumeSplitConsulExportSink(path, "vault", 0, 1024, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[30:]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenSplitConsulExportSource(path, "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/vault/physical"
+)
+
+// txnPayloadGlob matches the payload files of a transaction directory.
+const txnPayloadGlob = "txn-*.json"
+
+// TxnPayloadPath returns the name of payload i, counting from 1, in dir.
+func TxnPayloadPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("txn-%05d.json", i))
+}
+
+// TxnSink writes Vault data as a directory of Consul transaction API
+// payloads.  Each payload holds up to 64 KV set operations and may be
+// applied atomically with a PUT to /v1/txn, for example:
+//
+//	curl --fail --request PUT --data-binary @txn-00001.json \
+//	    http://127.0.0.1:8500/v1/txn
+//
+// Every key is set by exactly one payload, so payloads may be applied in
+// any order, and a failed payload may be retried on its own.  A value too
+// large to share a transaction is written to a payload of its own.  An
+// entry too large for any transaction is refused.
+type TxnSink struct {
+	dir          string
+	keyPrefix    string
+	maxValueSize int
+	batch        txnBatch
+	files        int
+}
+
+// OpenTxnSink creates dir if necessary.  Entries with values larger than
+// maxValueSize bytes are refused.  A maxValueSize of zero or less is no
+// limit.
+func OpenTxnSink(dir, consulPath string, maxValueSize int) (*TxnSink, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Stale payloads would be replayed alongside the new ones.
+	stale, err := filepath.Glob(filepath.Join(dir, txnPayloadGlob))
+	if err != nil {
+		return nil, err
+	}
+	if len(stale) > 0 {
+		return nil, fmt.Errorf("%s: already contains transaction payloads", dir)
+	}
+
+	return &TxnSink{dir: dir, keyPrefix: keyPrefix, maxValueSize: maxValueSize}, nil
+}
+
+// ResumeTxnSink reopens dir after a Checkpoint at pos.  Payloads written
+// after the checkpoint are removed.
+func ResumeTxnSink(dir, consulPath string, maxValueSize int, pos SinkPosition) (*TxnSink, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, txnPayloadGlob))
+	if err != nil {
+		return nil, err
+	}
+	var found int
+	for _, p := range paths {
+		var i int
+		if _, err := fmt.Sscanf(filepath.Base(p), "txn-%d.json", &i); err != nil {
+			continue
+		}
+		if i <= pos.File {
+			found++
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	if found != pos.File {
+		return nil, fmt.Errorf("%s: expected %d payloads before the checkpoint, found %d", dir, pos.File, found)
+	}
+
+	return &TxnSink{dir: dir, keyPrefix: keyPrefix, maxValueSize: maxValueSize, files: pos.File}, nil
+}
+
+func (s *TxnSink) Close() error {
+	return s.flush()
+}
+
+func (s *TxnSink) WriteEntry(ctx context.Context, entry *physical.Entry) error {
+	key := KeyAddPrefix(entry.Key, s.keyPrefix)
+	if err := checkValueSize(key, len(entry.Value), s.maxValueSize); err != nil {
+		return err
+	}
+
+	size := txnOpSize(key, entry.Value)
+	if size+txnFraming > maxTxnSize {
+		return fmt.Errorf("%s: value of %d bytes would make a transaction payload of %d bytes; Consul accepts at most %d bytes", key, len(entry.Value), size+txnFraming, maxTxnSize)
+	}
+	if !s.batch.fits(size) {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	s.batch.add(&api.KVTxnOp{Verb: api.KVSet, Key: key, Value: entry.Value}, size)
+	return nil
+}
+
+// Checkpoint writes the pending operations as a payload, even if it is not
+// full.
+func (s *TxnSink) Checkpoint() (SinkPosition, error) {
+	if err := s.flush(); err != nil {
+		return SinkPosition{}, err
+	}
+	return SinkPosition{File: s.files}, nil
+}
+
+// flush writes the pending operations as the next payload.
+func (s *TxnSink) flush() error {
+	kvOps := s.batch.take()
+	if len(kvOps) == 0 {
+		return nil
+	}
+
+	ops := make(api.TxnOps, 0, len(kvOps))
+	for _, op := range kvOps {
+		ops = append(ops, &api.TxnOp{KV: op})
+	}
+	buf, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	s.files++
+	return ioutil.WriteFile(TxnPayloadPath(s.dir, s.files), buf, 0600)
+}
+
+// TxnSource reads back the set operations of a directory written by TxnSink,
+// in payload order.
+type TxnSource struct {
+	keyPrefix string
+	paths     []string
+	pending   []*api.KVTxnOp
+}
+
+func OpenTxnSource(dir, consulPath string) (*TxnSource, error) {
+	keyPrefix, err := cleanConsulPath(consulPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, txnPayloadGlob))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return &TxnSource{keyPrefix: keyPrefix, paths: paths}, nil
+}
+
+func (s *TxnSource) Close() error {
+	return nil
+}
+
+// ReadEntry skips operations other than sets, and keys outside of the Vault
+// key prefix.
+func (s *TxnSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for len(s.pending) > 0 {
+			op := s.pending[0]
+			s.pending = s.pending[1:]
+			if op.Verb != api.KVSet || !KeyHasPrefix(op.Key, s.keyPrefix) {
+				continue
+			}
+			return &physical.Entry{Key: KeyStripPrefix(op.Key, s.keyPrefix), Value: op.Value}, nil
+		}
+
+		if len(s.paths) == 0 {
+			return nil, io.EOF
+		}
+		p := s.paths[0]
+		s.paths = s.paths[1:]
+
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var ops api.TxnOps
+		if err := json.Unmarshal(buf, &ops); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		for _, op := range ops {
+			if op.KV != nil {
+				s.pending = append(s.pending, op.KV)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/vault/physical"
+)
+
+func TestTxnRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	payloads := filepath.Join(dir, "txn")
+	entries := binaryEntries(3*maxTxnOps + 8)
+
+	sink, err := OpenSink(ctx, "consul-txn:"+payloads, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each payload is a transaction Consul would accept.
+	for i, want := range []int{maxTxnOps, maxTxnOps, maxTxnOps, 8} {
+		buf, err := ioutil.ReadFile(TxnPayloadPath(payloads, i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops api.TxnOps
+		if err := json.Unmarshal(buf, &ops); err != nil {
+			t.Fatal(err)
+		}
+		if len(ops) != want || len(buf) > maxTxnSize {
+			t.Errorf("payload %d: got %d operations in %d bytes, want %d", i+1, len(ops), len(buf), want)
+		}
+		if ops[0].KV.Verb != api.KVSet || ops[0].KV.Key != "vault/"+entries[i*maxTxnOps].Key {
+			t.Errorf("payload %d: got %s %s first", i+1, ops[0].KV.Verb, ops[0].KV.Key)
+		}
+	}
+
+	src, err := OpenSource(ctx, "consul-txn:"+payloads, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+
+	if _, err := OpenTxnSink(payloads, "vault", 0); err == nil {
+		t.Error("reopened a directory of payloads")
+	}
+}
+
+func TestTxnResume(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	entries := testEntries(3 * maxTxnOps)
+
+	// Payloads written after the checkpoint are removed on resume.
+	sink, err := OpenTxnSink(dir, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[:maxTxnOps+10]}); err != nil {
+		t.Fatal(err)
+	}
+	pos, err := sink.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: testEntries(5 * maxTxnOps)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err = ResumeTxnSink(dir, "vault", 0, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy(ctx, sink, &sliceSource{entries: entries[maxTxnOps+10:]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenTxnSource(dir, "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+	checkEntries(t, readEntries(t, src), entries)
+}
+
+func TestTxnSinkOversize(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	sink, err := OpenTxnSink(dir, "vault", DefaultConsulMaxValueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Within the value size limit, but not once base64-encoded.
+	large := &physical.Entry{Key: "logical/large", Value: bytes.Repeat([]byte{'x'}, 450*1024)}
+	if err := sink.WriteEntry(ctx, large); err == nil {
+		t.Error("wrote a value too large for a transaction")
+	}
+
+	fits := &physical.Entry{Key: "logical/fits", Value: bytes.Repeat([]byte{'x'}, 380*1024)}
+	if err := sink.WriteEntry(ctx, fits); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(TxnPayloadPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > maxTxnSize {
+		t.Errorf("payload is %d bytes, want at most %d", fi.Size(), maxTxnSize)
+	}
+}
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"sort"
+)
+
+// Reasons reported in a Mismatch.
+const (
+	OnlyInSource      = "only in source"
+	OnlyInDestination = "only in destination"
+	ValueDiffers      = "value differs"
+)
+
+// Mismatch describes a key that differs between two backends.
+type Mismatch struct {
+	Key    string
+	Reason string
+}
+
+func (m Mismatch) String() string {
+	return m.Reason + ": " + m.Key
+}
+
+// Verify compares the key sets of src and dst, and the SHA-256 of every
+// value.  The number of source entries and any mismatches, sorted by key,
+// are returned.  Only the digests of src are held in memory.
+func Verify(ctx context.Context, src, dst Source) (n int, mismatches []Mismatch, err error) {
+	sums := make(map[string][sha256.Size]byte)
+	for {
+		entry, err := src.ReadEntry(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		sums[entry.Key] = sha256.Sum256(entry.Value)
+	}
+	n = len(sums)
+
+	for {
+		entry, err := dst.ReadEntry(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		sum, ok := sums[entry.Key]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, Mismatch{Key: entry.Key, Reason: OnlyInDestination})
+		case sum != sha256.Sum256(entry.Value):
+			mismatches = append(mismatches, Mismatch{Key: entry.Key, Reason: ValueDiffers})
+		}
+		delete(sums, entry.Key)
+	}
+	for k := range sums {
+		mismatches = append(mismatches, Mismatch{Key: k, Reason: OnlyInSource})
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Key < mismatches[j].Key
+	})
+	return n, mismatches, nil
+}
+
+// VerifySpecs opens the backends named by srcSpec and dstSpec, and compares
+// them with Verify.  Only the source entries selected by filter are
+// expected in the destination.
+func VerifySpecs(ctx context.Context, srcSpec, dstSpec string, filter *Filter, opts *Options) (n int, mismatches []Mismatch, err error) {
+	src, err := OpenSource(ctx, srcSpec, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if closeError := src.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+
+	dst, err := OpenSource(ctx, dstSpec, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if closeError := dst.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+
+	return Verify(ctx, FilterSource(src, filter), dst)
+}
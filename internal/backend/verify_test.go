@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+)
+
+func TestVerify(t *testing.T) {
+	src := testEntries(5)
+	dst := []*physical.Entry{
+		src[0],
+		{Key: src[1].Key, Value: []byte("changed")},
+		src[3],
+		{Key: "logical/extra", Value: []byte("extra")},
+	}
+
+	n, mismatches, err := Verify(context.Background(), &sliceSource{entries: src}, &sliceSource{entries: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(src) {
+		t.Errorf("verified %d entries, want %d", n, len(src))
+	}
+	want := []Mismatch{
+		{Key: src[1].Key, Reason: ValueDiffers},
+		{Key: src[2].Key, Reason: OnlyInSource},
+		{Key: src[4].Key, Reason: OnlyInSource},
+		{Key: "logical/extra", Reason: OnlyInDestination},
+	}
+	if !reflect.DeepEqual(mismatches, want) {
+		t.Errorf("got %v, want %v", mismatches, want)
+	}
+}
+
+func TestVerifySpecs(t *testing.T) {
+	ctx := context.Background()
+	entries := testEntries(20)
+	f := &Filter{Exclude: []string{"logical/0001*"}}
+
+	for spec, entries := range map[string][]*physical.Entry{
+		"inmem:verify-src": entries,
+		"inmem:verify-dst": entries[:10],
+	} {
+		sink, err := OpenSink(ctx, spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Copy(ctx, sink, &sliceSource{entries: entries}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, mismatches, err := VerifySpecs(ctx, "inmem:verify-src", "inmem:verify-dst", f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || len(mismatches) != 0 {
+		t.Errorf("verified %d entries with mismatches %v, want 10 and none", n, mismatches)
+	}
+
+	_, mismatches, err = VerifySpecs(ctx, "inmem:verify-src", "inmem:verify-dst", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 10 {
+		t.Errorf("got %d mismatches without the filter, want 10", len(mismatches))
+	}
+}
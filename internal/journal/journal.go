@@ -0,0 +1,243 @@
+// Package journal maintains a tamper-evident local record of offline
+// modifications to Vault storage.
+//
+// Changes made directly to a storage backend bypass Vault's audit devices.
+// The journal stands in for them.  Each record names the modified key and
+// carries HMACs of the old and new values, so that auditors holding the
+// journal key can confirm a value without the journal disclosing it.  Every
+// record is also authenticated together with its predecessor's MAC; editing,
+// reordering, or removing a record breaks the chain.
+//
+// Records are written ahead of the changes they describe, so that no change
+// is made that the journal does not hold.  A change that then fails is
+// followed by an abort record.
+//
+// A value whose plaintext cannot be recovered, such as a corrupt entry being
+// repaired, is authenticated as stored instead, and the record says so.
+package journal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+)
+
+// maxRecordSize bounds the length of a single journal line.
+const maxRecordSize = 1024 * 1024
+
+const (
+	OperationPut    = "put"
+	OperationDelete = "delete"
+	// OperationAbort follows a put or delete of the same key that failed.
+	// The failed change may have been applied in part.
+	OperationAbort = "abort"
+)
+
+// Record is a single line of the journal.  The timestamp is kept as a string
+// so that a decoded record re-encodes to exactly the bytes that were
+// authenticated.
+type Record struct {
+	Seq       uint64 `json:"seq"`
+	Time      string `json:"time"`
+	User      string `json:"user"`
+	Program   string `json:"program"`
+	Operation string `json:"operation"`
+	Key       string `json:"key"`
+	// OldHMAC and NewHMAC are empty where no value existed.
+	OldHMAC string `json:"old_hmac,omitempty"`
+	NewHMAC string `json:"new_hmac,omitempty"`
+	// OldStored and NewStored are set where the HMAC is of the value as
+	// stored, rather than of its plaintext.
+	OldStored bool `json:"old_stored,omitempty"`
+	NewStored bool `json:"new_stored,omitempty"`
+	// Prev is the MAC of the preceding record, or empty for the first.
+	Prev string `json:"prev"`
+	MAC  string `json:"mac"`
+}
+
+// Value is a value as given to Append.
+type Value struct {
+	// Data is nil where no value exists.
+	Data []byte
+	// Stored is set if Data is the value as stored, because its plaintext
+	// could not be recovered.
+	Stored bool
+}
+
+type Journal struct {
+	file    *os.File
+	key     []byte
+	program string
+	user    string
+	seq     uint64
+	prev    string
+}
+
+// DeriveKey derives a journal key from a Vault master key.  Operators that
+// do not wish to share the master key with auditors should supply a
+// dedicated journal key instead.
+func DeriveKey(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("vault-tools journal key")) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// Open opens the journal at path for appending, creating it if necessary.
+// program is recorded in each record as the author of the change.
+func Open(path string, key []byte, program string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		file:    f,
+		key:     key,
+		program: program,
+		user:    currentUser(),
+	}
+
+	// Continue the chain from the last record.  Verification of the
+	// records themselves is left to Verify.
+	err = scan(f, func(r *Record) error {
+		j.seq = r.Seq
+		j.prev = r.MAC
+		return nil
+	})
+	if err != nil {
+		f.Close() // nolint: errcheck
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return j, nil
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Append records an operation on key.  oldValue and newValue are the values
+// before and after the operation.
+func (j *Journal) Append(operation, key string, oldValue, newValue Value) error {
+	r := &Record{
+		Seq:       j.seq + 1,
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		User:      j.user,
+		Program:   j.program,
+		Operation: operation,
+		Key:       key,
+		OldHMAC:   j.valueHMAC(oldValue.Data),
+		NewHMAC:   j.valueHMAC(newValue.Data),
+		OldStored: oldValue.Stored,
+		NewStored: newValue.Stored,
+		Prev:      j.prev,
+	}
+	mac, err := recordMAC(j.key, r)
+	if err != nil {
+		return err
+	}
+	r.MAC = mac
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.seq = r.Seq
+	j.prev = r.MAC
+	return nil
+}
+
+func (j *Journal) valueHMAC(value []byte) string {
+	if value == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, j.key)
+	mac.Write(value) // nolint: errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks every record in the journal at path against key.  The number
+// of valid records is returned.  Verify cannot detect the removal of records
+// from the end of the journal; compare the count against an external copy.
+func Verify(path string, key []byte) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	var (
+		valid int
+		prev  string
+	)
+	err = scan(f, func(r *Record) error {
+		n := valid + 1
+		if r.Seq != uint64(n) {
+			return fmt.Errorf("record %d: out of sequence: %d", n, r.Seq)
+		}
+		if r.Prev != prev {
+			return fmt.Errorf("record %d: chain broken: previous record does not match", n)
+		}
+		want, err := recordMAC(key, r)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(want), []byte(r.MAC)) {
+			return fmt.Errorf("record %d: MAC mismatch: record altered or wrong journal key", n)
+		}
+		prev = r.MAC
+		valid++
+		return nil
+	})
+	return valid, err
+}
+
+// recordMAC authenticates every field of r other than the MAC itself.
+func recordMAC(key []byte, r *Record) (string, error) {
+	c := *r
+	c.MAC = ""
+	buf, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf) // nolint: errcheck
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func scan(r io.Reader, fn func(*Record) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), maxRecordSize)
+	var line int
+	for s.Scan() {
+		line++
+		r := &Record{}
+		if err := json.Unmarshal(s.Bytes(), r); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
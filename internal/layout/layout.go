@@ -0,0 +1,61 @@
+// Package layout describes how Vault 0.10 lays out the entries in its
+// physical storage backend.  Nothing here requires the master key.
+package layout
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// KeyringPath holds the barrier keyring, encrypted under the master key
+	// rather than under the keyring itself.
+	KeyringPath = "core/keyring"
+
+	// TermSize is the number of bytes used to encode the key term at the
+	// head of each AES-GCM barrier ciphertext.
+	TermSize = 4
+
+	// NonceSize is the length of the nonce that follows the version byte.
+	// The barrier uses the standard GCM nonce size.
+	NonceSize = 12
+
+	// HeaderSize is the length of the term, version byte and nonce that
+	// precede the sealed data.
+	HeaderSize = TermSize + 1 + NonceSize
+)
+
+// UnencryptedKeys name entries written directly to the physical backend.
+// Their contents are either plaintext or opaque to the barrier.
+var UnencryptedKeys = map[string]bool{
+	"core/seal-config":             true,
+	"core/recovery-config":         true,
+	"core/unseal-keys-backup":      true,
+	"core/recovery-keys-backup":    true,
+	"core/hsm/barrier-unseal-keys": true,
+	"core/hsm/iv":                  true,
+}
+
+// ErrShortCiphertext is returned by ParseHeader if a value is too short to
+// be a barrier ciphertext.
+var ErrShortCiphertext = errors.New("ciphertext too short")
+
+// Header is the unauthenticated framing of a barrier ciphertext.
+type Header struct {
+	Term    uint32
+	Version byte
+	Nonce   []byte
+}
+
+// ParseHeader reads the framing at the head of a barrier ciphertext.  The
+// version byte is not validated.
+func ParseHeader(value []byte) (*Header, error) {
+	if len(value) < HeaderSize {
+		return nil, ErrShortCiphertext
+	}
+	return &Header{
+		Term:    binary.BigEndian.Uint32(value[:TermSize]),
+		Version: value[TermSize],
+		Nonce:   value[TermSize+1 : HeaderSize],
+	}, nil
+}
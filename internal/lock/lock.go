@@ -0,0 +1,188 @@
+// Package lock guards a Vault filesystem storage backend against concurrent
+// modification.
+//
+// Cooperating programs take an exclusive flock(2) on a lock file that sits
+// beside the backend directory; programs that only read take a shared one.
+// A running Vault server does not take this lock, so Acquire also looks for
+// signs of a live server: a process holding the HA lock entry open, or
+// recent modifications to the backend.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RecentWindow is the period within which modifications to the backend are
+// taken as a sign that a Vault server may be running.
+const RecentWindow = 5 * time.Minute
+
+// haLockPath is where a filesystem backend would hold core/lock.
+var haLockPath = filepath.Join("core", "_lock")
+
+// ErrLocked is returned if another cooperating program holds the lock.
+var ErrLocked = errors.New("storage backend is locked by another process")
+
+type Lock struct {
+	file   *os.File
+	shared bool
+}
+
+// Path returns the path of the lock file that guards backendPath.
+func Path(backendPath string) string {
+	return filepath.Clean(backendPath) + ".lock"
+}
+
+// Acquire takes an exclusive lock on the backend at backendPath.  If force
+// is set, signs of a live Vault server are ignored; the lock itself is never
+// overridden.
+func Acquire(backendPath string, force bool) (*Lock, error) {
+	return acquire(backendPath, force, false)
+}
+
+// AcquireShared takes a shared lock on the backend at backendPath, for a
+// program that only reads it.  Any number of readers may hold the lock at
+// once, but not alongside a writer.  Signs of a live Vault server are
+// checked as for Acquire.
+func AcquireShared(backendPath string, force bool) (*Lock, error) {
+	return acquire(backendPath, force, true)
+}
+
+func acquire(backendPath string, force, shared bool) (*Lock, error) {
+	f, err := os.OpenFile(Path(backendPath), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close() // nolint: errcheck
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%v: %s", ErrLocked, f.Name())
+		}
+		return nil, err
+	}
+	l := &Lock{file: f, shared: shared}
+
+	if !force {
+		if err := l.checkLive(backendPath); err != nil {
+			// Release would record a release time that hides the very
+			// modifications that were found.
+			l.abandon()
+			return nil, fmt.Errorf("%v; use --force to continue regardless", err)
+		}
+	}
+	return l, nil
+}
+
+// Release records the time of release, then drops the lock.  Modifications
+// made before this time are not mistaken for a live Vault server by
+// subsequent calls to Acquire.  A shared lock is dropped without recording
+// anything; its holder made no modifications.
+func (l *Lock) Release() error {
+	defer l.file.Close() // nolint: errcheck
+
+	if l.shared {
+		return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	}
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt([]byte(time.Now().UTC().Format(time.RFC3339Nano)+"\n"), 0); err != nil {
+		return err
+	}
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
+
+// abandon drops the lock without recording a release time.
+func (l *Lock) abandon() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN) // nolint: errcheck
+	l.file.Close()                                   // nolint: errcheck
+}
+
+func (l *Lock) checkLive(backendPath string) error {
+	haLock := filepath.Join(backendPath, haLockPath)
+	if pid, ok := heldOpen(haLock); ok {
+		return fmt.Errorf("%s is held open by process %d; Vault may be running", haLock, pid)
+	}
+
+	since := time.Now().Add(-RecentWindow)
+	if released := l.lastRelease(); released.After(since) {
+		since = released
+	}
+	if p, mtime, ok := modifiedSince(backendPath, since); ok {
+		return fmt.Errorf("%s was modified at %s; Vault may be running", p, mtime.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (l *Lock) lastRelease() time.Time {
+	buf, err := ioutil.ReadAll(l.file)
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(buf)))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// heldOpen searches /proc for a process with an open file descriptor on
+// path.  Systems without /proc report nothing.
+func heldOpen(path string) (int, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return 0, false
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || target != abs {
+			continue
+		}
+		var pid int
+		if _, err := fmt.Sscanf(fd, "/proc/%d/fd/", &pid); err == nil && pid != os.Getpid() {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+// modifiedSince reports the first of a small set of paths that was modified
+// after since.  Vault rewrites entries under core/ as it runs, and adds
+// entries to the directories near the root of the tree as it issues tokens
+// and leases.  The full tree is not walked; it may hold millions of entries.
+// The root's own modification time is ignored, so that a newly created,
+// empty directory is not mistaken for a live backend.
+func modifiedSince(backendPath string, since time.Time) (string, time.Time, bool) {
+	var candidates []string
+	for _, pattern := range []string{"*", "*/*", filepath.Join("core", "*")} {
+		matches, _ := filepath.Glob(filepath.Join(backendPath, pattern))
+		candidates = append(candidates, matches...)
+	}
+
+	for _, p := range candidates {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(since) {
+			return p, fi.ModTime(), true
+		}
+	}
+	return "", time.Time{}, false
+}
@@ -0,0 +1,92 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBackend(t *testing.T) (backendPath string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendPath = filepath.Join(dir, "backend")
+	if err := os.Mkdir(backendPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return backendPath, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func TestAcquireNewDirectory(t *testing.T) {
+	backendPath, cleanup := testBackend(t)
+	defer cleanup()
+
+	l, err := Acquire(backendPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireShared(t *testing.T) {
+	backendPath, cleanup := testBackend(t)
+	defer cleanup()
+
+	r1, err := AcquireShared(backendPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := AcquireShared(backendPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Acquire(backendPath, false); err == nil {
+		t.Fatal("acquired an exclusive lock alongside readers")
+	}
+	for _, l := range []*Lock{r1, r2} {
+		if err := l.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := Acquire(backendPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Release() // nolint: errcheck
+	if _, err := AcquireShared(backendPath, false); err == nil {
+		t.Fatal("acquired a shared lock alongside a writer")
+	}
+}
+
+func TestAcquireRecentlyModified(t *testing.T) {
+	backendPath, cleanup := testBackend(t)
+	defer cleanup()
+	if err := os.MkdirAll(filepath.Join(backendPath, "core"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(backendPath, "core", "_keyring"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refusal must not record a release time that hides the modification
+	// from the next attempt.
+	for i := 0; i < 2; i++ {
+		if _, err := Acquire(backendPath, false); err == nil {
+			t.Fatalf("attempt %d: acquired a recently modified backend", i+1)
+		}
+	}
+
+	l, err := Acquire(backendPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package mounttable reads Vault's secret and credential mount tables, and
+// translates between barrier keys and the logical paths at which Vault
+// exposes them.
+package mounttable
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/vault"
+)
+
+// Mount tables and the barrier prefixes beneath which each mount stores its
+// data.  See vault/mount.go and vault/auth.go.
+const (
+	coreMountConfigPath      = "core/mounts"
+	coreLocalMountConfigPath = "core/local-mounts"
+	coreAuthConfigPath       = "core/auth"
+	coreLocalAuthConfigPath  = "core/local-auth"
+
+	backendBarrierPrefix    = "logical/"
+	credentialBarrierPrefix = "auth/"
+	systemBarrierPrefix     = "sys/"
+
+	// CredentialRoutePrefix is the logical path prefix of credential
+	// mounts.
+	CredentialRoutePrefix = "auth/"
+)
+
+// Mount is an entry of a mount table.
+type Mount struct {
+	// Path is the logical path at which the mount is routed, for example
+	// "secret/" or "auth/userpass/".
+	Path string
+	Type string
+	// BarrierPrefix is the barrier key prefix beneath which the mount stores
+	// its data, for example "logical/<uuid>/".
+	BarrierPrefix string
+	Local         bool
+	// Options are the backend options of the mount, for example
+	// {"version": "2"} for a KV version 2 mount.
+	Options map[string]string
+}
+
+// IsKVv2 reports whether m is a KV secrets engine at version 2.  Version 2
+// keeps versioned data beneath versions/, under hashed keys, and metadata
+// beneath metadata/; barrier keys and logical paths do not correspond
+// directly.
+func (m *Mount) IsKVv2() bool {
+	return (m.Type == "kv" || m.Type == "generic") && m.Options["version"] == "2"
+}
+
+// Table lists the mounts of a barrier, sorted by logical path.
+type Table []*Mount
+
+// Load reads the secret and credential mount tables from the barrier.
+// Missing tables are treated as empty.
+func Load(ctx context.Context, barrier *vault.AESGCMBarrier) (Table, error) {
+	var mounts Table
+
+	tables := []struct {
+		key         string
+		routePrefix string
+		viewPrefix  string
+	}{
+		{coreMountConfigPath, "", backendBarrierPrefix},
+		{coreLocalMountConfigPath, "", backendBarrierPrefix},
+		{coreAuthConfigPath, CredentialRoutePrefix, credentialBarrierPrefix},
+		{coreLocalAuthConfigPath, CredentialRoutePrefix, credentialBarrierPrefix},
+	}
+	for _, t := range tables {
+		entry, err := barrier.Get(ctx, t.key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		table := &vault.MountTable{}
+		if err := jsonutil.DecodeJSON(entry.Value, table); err != nil {
+			return nil, err
+		}
+
+		for _, me := range table.Entries {
+			barrierPrefix := t.viewPrefix + me.UUID + "/"
+			if me.Type == "system" {
+				barrierPrefix = systemBarrierPrefix
+			}
+			mounts = append(mounts, &Mount{
+				Path:          t.routePrefix + me.Path,
+				Type:          me.Type,
+				BarrierPrefix: barrierPrefix,
+				Local:         me.Local,
+				Options:       me.Options,
+			})
+		}
+	}
+
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+	return mounts, nil
+}
+
+// Resolve finds the mount that owns the barrier key.  The mount-relative
+// remainder of the key is returned alongside.  A nil mount is returned if
+// the key does not belong to any mount.
+func (t Table) Resolve(key string) (*Mount, string) {
+	var best *Mount
+	for _, m := range t {
+		if strings.HasPrefix(key, m.BarrierPrefix) {
+			if best == nil || len(m.BarrierPrefix) > len(best.BarrierPrefix) {
+				best = m
+			}
+		}
+	}
+	if best == nil {
+		return nil, key
+	}
+	return best, strings.TrimPrefix(key, best.BarrierPrefix)
+}
+
+// LogicalPath translates a barrier key into the path at which Vault would
+// expose it, for example "logical/<uuid>/foo" to "secret/foo".  Keys that do
+// not belong to any mount are returned unchanged.
+func (t Table) LogicalPath(key string) string {
+	m, rest := t.Resolve(key)
+	if m == nil {
+		return key
+	}
+	return m.Path + rest
+}
+
+// Route finds the mount at which Vault would route the logical path, for
+// example "secret/foo" to the mount at "secret/".  The mount-relative
+// remainder of the path is returned alongside.  A nil mount is returned if
+// no mount matches.
+func (t Table) Route(logical string) (*Mount, string) {
+	var best *Mount
+	for _, m := range t {
+		if strings.HasPrefix(logical, m.Path) {
+			if best == nil || len(m.Path) > len(best.Path) {
+				best = m
+			}
+		}
+	}
+	if best == nil {
+		return nil, logical
+	}
+	return best, strings.TrimPrefix(logical, best.Path)
+}
+
+// ByPath returns the mount routed at exactly p, or nil.
+func (t Table) ByPath(p string) *Mount {
+	for _, m := range t {
+		if m.Path == p {
+			return m
+		}
+	}
+	return nil
+}
+
+// OrphanPrefix returns the "logical/<uuid>/" or "auth/<uuid>/" prefix of a
+// key that lies within a mount's storage area but that Resolve could not
+// attribute to a mount.
+func OrphanPrefix(key string) (string, bool) {
+	for _, p := range []string{backendBarrierPrefix, credentialBarrierPrefix} {
+		if !strings.HasPrefix(key, p) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, p)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			return p + rest[:i+1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,176 @@
+// Package stage writes output beside its destination, and moves it into
+// place only once it is complete.
+//
+// Output for OUTPUT is written beneath the sibling directory OUTPUT.staging,
+// under the same base name.  Commit makes the staged tree durable, then
+// renames it into place.  An interrupted run leaves the destination
+// untouched; its staging directory may be resumed or discarded.
+package stage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Permissions of staged output.  Vault's filesystem storage backend creates
+// its directories and files with these modes.
+const (
+	DirMode  = 0700
+	FileMode = 0600
+)
+
+// Stage stages output for a single target.
+type Stage struct {
+	target string
+	dir    string
+}
+
+// New returns the stage for output to target.
+func New(target string) *Stage {
+	target = filepath.Clean(target)
+	return &Stage{target: target, dir: target + ".staging"}
+}
+
+// Path returns where output for the target should be written.
+func (s *Stage) Path() string {
+	return filepath.Join(s.dir, filepath.Base(s.target))
+}
+
+// Prepare creates the staging directory.  Unless resume is set, anything
+// left in it by an earlier run is discarded.
+func (s *Stage) Prepare(resume bool) error {
+	if resume {
+		if _, err := os.Stat(s.dir); err != nil {
+			return fmt.Errorf("cannot resume: %v", err)
+		}
+		return nil
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, DirMode)
+}
+
+// Commit syncs everything in the staging directory to disk, then renames
+// each entry over the entry of the same name beside the target.  Existing
+// directories are replaced whole.  The destination paths are returned.
+func (s *Stage) Commit() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := syncTree(filepath.Join(s.dir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	if err := syncPath(s.dir); err != nil {
+		return nil, err
+	}
+
+	parent := filepath.Dir(s.target)
+	var paths []string
+	for _, e := range entries {
+		dst := filepath.Join(parent, e.Name())
+		if err := replace(dst, filepath.Join(s.dir, e.Name())); err != nil {
+			return paths, err
+		}
+		paths = append(paths, dst)
+	}
+	if err := syncPath(parent); err != nil {
+		return paths, err
+	}
+	return paths, os.Remove(s.dir)
+}
+
+// IsEmpty reports whether path does not exist, or is an empty file or
+// directory.
+func IsEmpty(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() {
+		return fi.Size() == 0, nil
+	}
+	names, err := readDirNames(path)
+	if err != nil {
+		return false, err
+	}
+	return len(names) == 0, nil
+}
+
+// replace renames src to dst.  rename(2) cannot replace a non-empty
+// directory, so an existing dst is first moved aside.
+func replace(dst, src string) error {
+	fi, err := os.Lstat(dst)
+	if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return os.Rename(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	aside, err := ioutil.TempDir(filepath.Dir(dst), "."+filepath.Base(dst)+".old")
+	if err != nil {
+		return err
+	}
+	old := filepath.Join(aside, filepath.Base(dst))
+	if err := os.Rename(dst, old); err != nil {
+		os.Remove(aside) // nolint: errcheck
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst) // nolint: errcheck
+		os.Remove(aside)    // nolint: errcheck
+		return err
+	}
+	return os.RemoveAll(aside)
+}
+
+// syncTree sets the permissions of every directory and file beneath root,
+// and syncs each to disk.
+func syncTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(FileMode)
+		if info.IsDir() {
+			mode = DirMode
+		}
+		if info.Mode().Perm() != mode {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+		return syncPath(path)
+	})
+}
+
+func syncPath(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeError := f.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+	return f.Sync()
+}
+
+func readDirNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return f.Readdirnames(-1)
+}
@@ -22,3 +22,10 @@ func decodeKeyBase64(key []byte) ([]byte, error) {
 	}
 	return decoded[0:n], nil
 }
+
+// Zeroize overwrites key material in place.
+func Zeroize(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// CancelOnInterrupt cancels the returned context on SIGINT or SIGTERM, so
+// that work in progress may stop cleanly.  A second signal is handled as
+// usual.  Call stop to restore the default handling.
+func CancelOnInterrupt(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-c:
+			signal.Stop(c)
+			cancel()
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(c)
+		close(done)
+		cancel()
+	}
+}
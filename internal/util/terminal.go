@@ -22,10 +22,14 @@ func NewTerminal() (*Terminal, error) {
 	if err != nil {
 		return nil, err
 	}
+	term := terminal.NewTerminal(f, "")
+	if width, height, err := terminal.GetSize(int(f.Fd())); err == nil && width > 0 {
+		term.SetSize(width, height) // nolint: errcheck
+	}
 	return &Terminal{
 		file:      f,
 		prevState: prevState,
-		term:      terminal.NewTerminal(f, ""),
+		term:      term,
 	}, nil
 }
 
@@ -55,6 +59,23 @@ func (t *Terminal) ReadKeyBase64(prompt string) ([]byte, error) {
 	return DecodeKeyBase64String(line)
 }
 
+func (t *Terminal) ReadLine(prompt string) (string, error) {
+	if t.term == nil {
+		return "", errors.New("terminal not initialised")
+	}
+
+	t.term.SetPrompt(prompt)
+	return t.term.ReadLine()
+}
+
+// SetAutoCompleteCallback installs a callback that is invoked on each
+// keypress during ReadLine.  See golang.org/x/crypto/ssh/terminal.
+func (t *Terminal) SetAutoCompleteCallback(f func(line string, pos int, key rune) (newLine string, newPos int, ok bool)) {
+	if t.term != nil {
+		t.term.AutoCompleteCallback = f
+	}
+}
+
 func findTerminal() (*os.File, error) {
 	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
 		if terminal.IsTerminal(int(f.Fd())) {
@@ -2,225 +2,325 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 
-	consul "github.com/hashicorp/consul/command/kv/impexp"
 	hclog "github.com/hashicorp/go-hclog"
-	vault "github.com/hashicorp/vault/physical"
-	"github.com/hashicorp/vault/physical/file"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/lock"
+	"github.com/saj/vault-tools/internal/stage"
+	"github.com/saj/vault-tools/internal/util"
 )
 
 const progname = "vault-convert-backend-consul-filesystem"
 
+// allConsulPaths selects every Vault root found by --discover.
+const allConsulPaths = "all"
+
 func main() {
 	app := kingpin.New(progname,
 		"Convert Vault data from a Consul storage backend to a filesystem storage backend.\n\n"+
-			"Input must be a JSON-serialised Consul KV tree.  Consul will output KV data in this format with 'consul kv export'.\n\n"+
+			"Input must be a JSON-serialised Consul KV tree.  Consul will output KV data in this format with 'consul kv export'.  Alternatively, name a live Consul agent as consul:ADDR to read its KV store directly.\n\n"+
 			"Output will be a filesystem tree.  The root of this tree may be loaded into Vault's filesystem storage backend.\n\n"+
+			"A full export may hold several Vault clusters under different prefixes.  --discover lists them, with / for a cluster at the top level of the KV store; --consul-path=all converts each to its own subdirectory of the output directory, named for its prefix with / replaced by _.  The data of a cluster nested beneath another's prefix is left out of the outer cluster's output.\n\n"+
 			"Example:\n\n"+
 			"    consul kv export vault >vault.json\n"+
-			"    vault-backend-convert-consul-file vault.json backend\n").
+			"    vault-backend-convert-consul-file vault.json backend\n"+
+			"    vault-backend-convert-consul-file consul:127.0.0.1:8500 backend\n\n"+
+			"    consul kv export >everything.json\n"+
+			"    "+progname+" --discover everything.json\n"+
+			"    "+progname+" --consul-path=all everything.json backends\n").
 		UsageTemplate(kingpin.CompactUsageTemplate)
-	consulPath := app.Flag("consul-path",
-		"Consul key prefix for Vault data.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").
-		Default("vault").String()
+	opts := &backend.Options{}
+	app.Flag("consul-path",
+		"Consul key prefix for Vault data, or all for every prefix listed by --discover.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").
+		Default("vault").StringVar(&opts.ConsulPath)
+	backend.ConsulFlags(app, opts)
+	filter := &backend.Filter{}
+	backend.FilterFlags(app, filter)
+	force := app.Flag("force",
+		"Replace the output directory even if it is not empty, or if a Vault server appears to be using it.  The program takes an advisory lock on OUTPUT.lock, and refuses to run if a process holds core/lock open or if the directory was modified in the last few minutes by something other than these tools.").
+		Bool()
+	discover := app.Flag("discover",
+		"List the key prefixes of the input that look like Vault roots, with the number of entries beneath each, then exit.  A Vault root holds both core/keyring and core/seal-config.").
+		Bool()
+	checkpointPath := app.Flag("checkpoint",
+		"Record progress in this file every "+strconv.Itoa(backend.CheckpointInterval)+" entries, and when interrupted.  Defaults to OUTPUT.checkpoint.  Not allowed with --consul-path=all, which keeps a checkpoint beside each output directory.").
+		PlaceHolder("PATH").String()
+	resume := app.Flag("resume",
+		"Continue an interrupted conversion from its checkpoint, skipping entries already written.  The input must not have changed in the meantime.  With --consul-path=all, outputs with a checkpoint are resumed, non-empty outputs without one are taken as complete and skipped, and empty outputs are converted afresh.").
+		Bool()
+	verify := app.Flag("verify",
+		"After converting, read back the input and output and compare their keys and the SHA-256 of every value.  Mismatches are listed on standard error.").
+		Bool()
 	inputPath := app.Arg("consul-input",
-		"Local filesystem path to an existing file that contains a JSON-serialised Consul KV export.").
+		"Local filesystem path to an existing file that contains a JSON-serialised Consul KV export, or consul:ADDR.").
 		Required().String()
 	outputPath := app.Arg("filesystem-output",
-		"Local filesystem path to the output directory.  The directory will be created if it does not exist.").
-		Required().String()
+		"Local filesystem path to the output directory, which must be empty or not exist.  Output is written to OUTPUT.staging, and moved into place only once it is complete.  Required unless --discover is given.").
+		String()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := util.CancelOnInterrupt(context.Background())
+	defer stop()
 
-	if err := convert(ctx, *inputPath, *outputPath, *consulPath); err != nil {
-		app.Fatalf("%v", err)
+	opts.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:  progname,
+		Level: hclog.LevelFromString("INFO"),
+	})
+	inputSpec := backend.SchemeConsulExport + ":" + *inputPath
+	if strings.HasPrefix(*inputPath, backend.SchemeConsul+":") {
+		inputSpec = *inputPath
 	}
-}
 
-func convert(ctx context.Context, inputPath, outputPath, consulPath string) (err error) {
-	cb, openError := openConsulBackend(inputPath, consulPath)
-	if openError != nil {
-		return openError
-	}
-	defer func() {
-		if closeError := cb.Close(); closeError != nil && err == nil {
-			err = closeError
+	if *discover {
+		if err := discoverRoots(ctx, inputSpec, opts); err != nil {
+			app.Fatalf("%v", err)
 		}
-	}()
-
-	fb, openError := openFilesystemBackend(outputPath)
-	if openError != nil {
-		return openError
+		return
+	}
+	if *outputPath == "" {
+		app.Fatalf("required argument 'filesystem-output' not provided, try --help")
 	}
-	defer func() {
-		if closeError := fb.Close(); closeError != nil && err == nil {
-			err = closeError
-		}
-	}()
 
-conversion:
-	for {
-		ce, readError := cb.ReadEntry()
-		if readError != nil {
-			if readError == io.EOF {
-				break conversion
-			}
-			return readError
-		}
+	c := &conversion{
+		inputSpec: inputSpec,
+		filter:    filter,
+		opts:      opts,
+		force:     *force,
+		verify:    *verify,
+	}
 
-		ve, conversionError := convertEntry(ce, consulPath)
-		if conversionError != nil {
-			return conversionError
+	if opts.ConsulPath != allConsulPaths {
+		if *checkpointPath == "" {
+			*checkpointPath = backend.CheckpointPath(*outputPath)
 		}
-
-		if writeError := fb.WriteEntry(ctx, ve); writeError != nil {
-			return writeError
+		if err := c.run(ctx, *outputPath, *checkpointPath, *resume); err != nil {
+			app.Fatalf("%v", interrupted(ctx, err, *checkpointPath))
 		}
+		return
+	}
+	if *checkpointPath != "" {
+		app.Fatalf("--checkpoint is not allowed with --consul-path=%s", allConsulPaths)
 	}
-	return nil
-}
-
-type filesystemBackend struct {
-	backend vault.Backend
-}
-
-func openFilesystemBackend(backendPath string) (*filesystemBackend, error) {
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name:  progname,
-		Level: hclog.LevelFromString("INFO"),
-	})
-
-	conf := map[string]string{"path": backendPath}
 
-	backend, err := file.NewFileBackend(conf, logger)
+	roots, err := discoverOutputs(ctx, inputSpec, *outputPath, opts)
 	if err != nil {
-		return nil, err
+		app.Fatalf("%v", err)
+	}
+	if err := c.runAll(ctx, roots, *resume); err != nil {
+		app.Fatalf("%v", err)
 	}
-
-	return &filesystemBackend{backend: backend}, nil
-}
-
-func (be *filesystemBackend) Close() error {
-	return nil
 }
 
-func (be *filesystemBackend) WriteEntry(ctx context.Context, entry *vault.Entry) error {
-	return be.backend.Put(ctx, entry)
+// conversion holds the settings shared by every output of a run.
+type conversion struct {
+	inputSpec string
+	filter    *backend.Filter
+	opts      *backend.Options
+	force     bool
+	verify    bool
 }
 
-type consulBackend struct {
-	file      io.ReadCloser
-	decoder   *json.Decoder
-	keyPrefix string
-}
+// run converts the input into outputPath while holding the output
+// directory's advisory lock.  The output is staged, and replaces outputPath
+// only once it is complete.  Progress is recorded at checkpointPath.
+func (c *conversion) run(ctx context.Context, outputPath, checkpointPath string, resume bool) (err error) {
+	l, err := lock.Acquire(outputPath, c.force)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseError := l.Release(); releaseError != nil && err == nil {
+			err = releaseError
+		}
+	}()
 
-func openConsulBackend(backendPath, consulPath string) (*consulBackend, error) {
-	keyPrefix := path.Clean(consulPath)
-	if keyPrefix == "/" || keyPrefix == "." {
-		return nil, fmt.Errorf("invalid Consul path: %v", consulPath)
+	if !c.force {
+		empty, err := stage.IsEmpty(outputPath)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("%s is not empty; use --force to replace it", outputPath)
+		}
 	}
 
-	f, err := os.Open(backendPath)
+	cp, err := backend.PrepareCheckpoint(checkpointPath, resume)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	be := &consulBackend{
-		file:      f,
-		decoder:   json.NewDecoder(f),
-		keyPrefix: keyPrefix,
+	output := stage.New(outputPath)
+	if err := output.Prepare(cp != nil); err != nil {
+		return err
 	}
-
-	if err := be.eatHeader(); err != nil {
-		f.Close() // nolint: errcheck
-		return nil, err
+	if err := convert(ctx, c.inputSpec, output.Path(), checkpointPath, cp, c.filter, c.opts); err != nil {
+		return err
+	}
+	if _, err := output.Commit(); err != nil {
+		return err
+	}
+	if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return be, nil
-}
 
-func (be *consulBackend) Close() error {
-	return be.file.Close()
+	if c.verify {
+		return verifyConversion(ctx, c.inputSpec, backend.SchemeFile+":"+outputPath, c.filter, c.opts)
+	}
+	return nil
 }
 
-func (be *consulBackend) ReadEntry() (*consul.Entry, error) {
-	entry := &consul.Entry{}
-scan:
-	for {
-		if !be.decoder.More() {
-			return nil, io.EOF
+// runAll converts each root to its own output.  When resuming, roots with a
+// checkpoint continue from it, and roots whose output is complete, without a
+// checkpoint, are skipped.
+func (c *conversion) runAll(ctx context.Context, roots []rootOutput, resume bool) error {
+	for _, r := range roots {
+		rootOpts := *c.opts
+		rootOpts.ConsulPath = r.prefix
+		rootFilter := *c.filter
+		rootFilter.Exclude = append(append([]string(nil), c.filter.Exclude...), r.exclude...)
+		rc := *c
+		rc.opts = &rootOpts
+		rc.filter = &rootFilter
+
+		rootCheckpoint := backend.CheckpointPath(r.outputPath)
+		_, statError := os.Stat(rootCheckpoint)
+		hasCheckpoint := statError == nil
+		if resume && !hasCheckpoint {
+			empty, err := stage.IsEmpty(r.outputPath)
+			if err != nil {
+				return fmt.Errorf("%s: %v", r.prefix, err)
+			}
+			if !empty {
+				fmt.Fprintf(os.Stderr, "%s: skipped %s: %s was already converted\n", progname, r.prefix, r.outputPath)
+				continue
+			}
 		}
 
-		if err := be.decoder.Decode(entry); err != nil {
-			return nil, err
+		if err := rc.run(ctx, r.outputPath, rootCheckpoint, resume && hasCheckpoint); err != nil {
+			return fmt.Errorf("%s: %v", r.prefix, interrupted(ctx, err, rootCheckpoint))
 		}
+		fmt.Fprintf(os.Stderr, "%s: converted %s to %s\n", progname, r.prefix, r.outputPath)
+	}
+	return nil
+}
 
-		if keyHasPrefix(entry.Key, be.keyPrefix) {
-			break scan
-		}
+// interrupted rewrites err to explain how to resume, if a checkpoint was
+// left behind.
+func interrupted(ctx context.Context, err error, checkpointPath string) error {
+	if ctx.Err() != nil {
+		err = errors.New("interrupted")
+	}
+	if _, statError := os.Stat(checkpointPath); statError == nil {
+		return fmt.Errorf("%v; run again with --resume to continue from %s", err, checkpointPath)
 	}
-	return entry, nil
+	return err
 }
 
-// eatHeader positions a new file cursor at the start of the key-value object
-// sequence.
-func (be *consulBackend) eatHeader() error {
-	t, err := be.decoder.Token()
+func discoverRoots(ctx context.Context, inputSpec string, opts *backend.Options) error {
+	keys, err := backend.ListConsulKeys(ctx, inputSpec, opts)
 	if err != nil {
 		return err
 	}
-	if t != json.Delim('[') {
-		return fmt.Errorf("expected JSON token: '[', got: %s", t)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tENTRIES")
+	for _, r := range backend.DiscoverVaultRoots(keys) {
+		fmt.Fprintf(tw, "%s\t%d\n", r.Prefix, r.Entries)
 	}
-	return nil
+	return tw.Flush()
+}
+
+type rootOutput struct {
+	prefix     string
+	outputPath string
+	// exclude holds filter patterns for the roots nested beneath prefix.
+	exclude []string
 }
 
-func convertEntry(entry *consul.Entry, keyPrefix string) (*vault.Entry, error) {
-	v, err := base64.StdEncoding.DecodeString(entry.Value)
+// discoverOutputs finds every Vault root of the input, and names an output
+// directory for each beneath outputPath.
+func discoverOutputs(ctx context.Context, inputSpec, outputPath string, opts *backend.Options) ([]rootOutput, error) {
+	keys, err := backend.ListConsulKeys(ctx, inputSpec, opts)
 	if err != nil {
 		return nil, err
 	}
+	roots := backend.DiscoverVaultRoots(keys)
+	if len(roots) == 0 {
+		return nil, errors.New("no Vault roots found in input")
+	}
+
+	if err := os.MkdirAll(outputPath, 0700); err != nil {
+		return nil, err
+	}
 
-	return &vault.Entry{
-		Key:   keyStripPrefix(entry.Key, keyPrefix),
-		Value: v,
-	}, nil
+	var outputs []rootOutput
+	names := make(map[string]string)
+	for _, r := range roots {
+		name := strings.Replace(r.Prefix, "/", "_", -1)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("prefixes %s and %s would share output directory %s", other, r.Prefix, name)
+		}
+		names[name] = r.Prefix
+		outputs = append(outputs, rootOutput{
+			prefix:     r.Prefix,
+			outputPath: filepath.Join(outputPath, name),
+			exclude:    backend.NestedRootPatterns(r, roots),
+		})
+	}
+	return outputs, nil
 }
 
-func keyHasPrefix(key, prefix string) bool {
-	ke := strings.Split(key, "/")
-	pe := strings.Split(prefix, "/")
-	if len(ke) < len(pe) {
-		return false
+// convert copies the input to outputPath, recording progress at
+// checkpointPath.  If cp is not nil, the copy resumes from it.
+func convert(ctx context.Context, inputSpec, outputPath, checkpointPath string, cp *backend.Checkpoint, filter *backend.Filter, opts *backend.Options) (err error) {
+	if cp != nil {
+		fmt.Fprintf(os.Stderr, "%s: resuming after %d entries, from %s\n", progname, cp.Entries, cp.LastKey)
 	}
-	for i := range pe {
-		if ke[i] != pe[i] {
-			return false
+
+	src, openError := backend.OpenSource(ctx, inputSpec, opts)
+	if openError != nil {
+		return openError
+	}
+	defer func() {
+		if closeError := src.Close(); closeError != nil && err == nil {
+			err = closeError
 		}
+	}()
+
+	fb, openError := backend.NewFileBackend(outputPath, opts.Logger)
+	if openError != nil {
+		return openError
 	}
-	return true
+	dst := backend.NewPhysicalSink(fb)
+	defer func() {
+		if closeError := dst.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+
+	_, err = backend.CopyWithCheckpoints(ctx, dst, backend.FilterSource(src, filter), checkpointPath, cp)
+	return err
 }
 
-func keyStripPrefix(key, prefix string) string {
-	ke := strings.Split(key, "/")
-	pe := strings.Split(prefix, "/")
-	if len(ke) < len(pe) {
-		return strings.Join(ke, "/")
+func verifyConversion(ctx context.Context, inputSpec, outputSpec string, filter *backend.Filter, opts *backend.Options) error {
+	n, mismatches, err := backend.VerifySpecs(ctx, inputSpec, outputSpec, filter, opts)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
 	}
-	for i := range pe {
-		if ke[i] != pe[i] {
-			return strings.Join(ke, "/")
-		}
+	for _, m := range mismatches {
+		fmt.Fprintln(os.Stderr, m)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("verify: %d mismatched keys", len(mismatches))
 	}
-	return strings.Join(ke[len(pe):], "/")
+	fmt.Fprintf(os.Stderr, "%s: verified %d entries\n", progname, n)
+	return nil
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/stage"
+)
+
+// writeExport writes an export holding Vault roots a and b, each with n
+// logical entries.
+func writeExport(t *testing.T, path string, n int) {
+	t.Helper()
+	sink, err := backend.OpenConsulExportSink(path, backend.TopLevelPrefix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{"a", "b"} {
+		keys := []string{"core/keyring", "core/seal-config"}
+		for i := 0; i < n; i++ {
+			keys = append(keys, fmt.Sprintf("logical/%05d", i))
+		}
+		for _, k := range keys {
+			entry := &physical.Entry{Key: root + "/" + k, Value: []byte(k)}
+			if err := sink.WriteEntry(context.Background(), entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testConversion(t *testing.T, dir string) (*conversion, []rootOutput) {
+	t.Helper()
+	input := filepath.Join(dir, "all.json")
+	writeExport(t, input, 10)
+
+	c := &conversion{
+		inputSpec: backend.SchemeConsulExport + ":" + input,
+		filter:    &backend.Filter{},
+		opts:      &backend.Options{},
+		verify:    true,
+	}
+	roots, err := discoverOutputs(context.Background(), c.inputSpec, filepath.Join(dir, "out"), c.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("found %d roots, want 2", len(roots))
+	}
+	return c, roots
+}
+
+// cancelSource cancels its context after n entries.
+type cancelSource struct {
+	backend.Source
+	n      int
+	cancel context.CancelFunc
+}
+
+func (s *cancelSource) ReadEntry(ctx context.Context) (*physical.Entry, error) {
+	if s.n == 0 {
+		s.cancel()
+	}
+	s.n--
+	return s.Source.ReadEntry(ctx)
+}
+
+// interrupt leaves r as an interrupted run would: staged output of n
+// entries, and a checkpoint.
+func interrupt(t *testing.T, c *conversion, r rootOutput, n int) {
+	t.Helper()
+	opts := *c.opts
+	opts.ConsulPath = r.prefix
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := backend.OpenSource(ctx, c.inputSpec, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close() // nolint: errcheck
+
+	output := stage.New(r.outputPath)
+	if err := output.Prepare(false); err != nil {
+		t.Fatal(err)
+	}
+	fb, err := backend.NewFileBackend(output.Path(), opts.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := backend.CheckpointPath(r.outputPath)
+	_, err = backend.CopyWithCheckpoints(ctx, backend.NewPhysicalSink(fb), &cancelSource{Source: src, n: n, cancel: cancel}, checkpoint, nil)
+	if err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunAllResumeComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-filesystem-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	c, roots := testConversion(t, dir)
+
+	if err := c.runAll(context.Background(), roots, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.runAll(context.Background(), roots, true); err != nil {
+		t.Fatalf("resume after a complete run: %v", err)
+	}
+}
+
+func TestRunAllResumeInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-filesystem-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	c, roots := testConversion(t, dir)
+
+	if err := c.runAll(context.Background(), roots[:1], false); err != nil {
+		t.Fatal(err)
+	}
+	interrupt(t, c, roots[1], 5)
+
+	// The first root is skipped, and the second resumed and verified.
+	if err := c.runAll(context.Background(), roots, true); err != nil {
+		t.Fatalf("resume after an interrupted run: %v", err)
+	}
+	for _, r := range roots {
+		empty, err := stage.IsEmpty(r.outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty {
+			t.Errorf("%s: output is empty", r.prefix)
+		}
+		if _, err := os.Stat(backend.CheckpointPath(r.outputPath)); !os.IsNotExist(err) {
+			t.Errorf("%s: checkpoint left behind", r.prefix)
+		}
+	}
+}
@@ -1,22 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
-	"path"
-	"sort"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 
-	consul "github.com/hashicorp/consul/command/kv/impexp"
 	hclog "github.com/hashicorp/go-hclog"
-	vault "github.com/hashicorp/vault/physical"
-	"github.com/hashicorp/vault/physical/file"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/mounttable"
+	"github.com/saj/vault-tools/internal/stage"
+	"github.com/saj/vault-tools/internal/util"
 )
 
 const progname = "vault-convert-backend-filesystem-consul"
@@ -25,267 +28,304 @@ func main() {
 	app := kingpin.New(progname,
 		"Convert Vault data from a filesystem storage backend to a Consul storage backend.\n\n"+
 			"Input must be a quiesced filesystem tree.\n\n"+
-			"Output will be a JSON-serialised Consul KV tree.  This file may be imported into a Consul KV store with 'consul kv import'.\n\n").
+			"Output will be a JSON-serialised Consul KV tree.  This file may be imported into a Consul KV store with 'consul kv import'.  Alternatively, name a live Consul agent as consul:ADDR to write to its KV store directly, in transactions of up to 64 keys.\n\n"+
+			"With --format=txn, output will instead be a directory of Consul transaction API payloads, each of up to 64 keys.  Each payload is applied atomically, and may be replayed on its own if it fails.  A value that would not fit in a payload of 512 KiB once base64-encoded, about 384 KiB, is refused:\n\n"+
+			"    for f in OUTPUT/txn-*.json; do curl --fail --request PUT --data-binary @$f http://127.0.0.1:8500/v1/txn || break; done\n\n"+
+			"Consul rejects values larger than 512 KiB by default.  Every value is checked against --max-value-size before any output is written.  Oversized entries are listed, by logical path if --master-key is given.\n\n").
 		UsageTemplate(kingpin.CompactUsageTemplate)
-	consulPath := app.Flag("consul-path",
+	opts := &backend.Options{}
+	app.Flag("consul-path",
 		"Consul key prefix for Vault data.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").
-		Default("vault").String()
+		Default("vault").StringVar(&opts.ConsulPath)
+	backend.ConsulFlags(app, opts)
+	backend.ConsulLimitFlags(app, opts)
+	masterKeyPath := app.Flag("master-key",
+		"Path to a file that contains the base64-encoded Vault master key.  Used only to name oversized entries by their logical path.").
+		PlaceHolder("PATH").ExistingFile()
+	filter := &backend.Filter{}
+	backend.FilterFlags(app, filter)
+	app.Flag("parallel",
+		"Maximum number of concurrent directory listings and file reads against the input backend.").
+		Default(strconv.Itoa(backend.DefaultParallel)).IntVar(&opts.Parallel)
+	format := app.Flag("format",
+		"Output format: export for 'consul kv import', or txn for a directory of /v1/txn payloads.").
+		Default("export").Enum("export", "txn")
+	checkpointPath := app.Flag("checkpoint",
+		"Record progress in this file every "+strconv.Itoa(backend.CheckpointInterval)+" entries, and when interrupted.  Defaults to OUTPUT.checkpoint, unless the output is consul:ADDR.").
+		PlaceHolder("PATH").String()
+	resume := app.Flag("resume",
+		"Continue an interrupted conversion from its checkpoint, skipping entries already written.  The input must not have changed in the meantime.").
+		Bool()
+	force := app.Flag("force",
+		"Replace existing output.  Without --force, the program refuses to run if the output file or directory is not empty.").
+		Bool()
+	verify := app.Flag("verify",
+		"After converting, read back the input and output and compare their keys and the SHA-256 of every value.  Mismatches are listed on standard error.").
+		Bool()
 	inputPath := app.Arg("filesystem-input",
 		"Local filesystem path to an existing directory that contains a Vault filesystem storage backend.").
 		Required().String()
 	outputPath := app.Arg("consul-output",
-		"Local filesystem path to the output file.  Any existing file will be overwritten.").
+		"Local filesystem path to the output file, or to the output directory with --format=txn, or consul:ADDR.  Output is written to OUTPUT.staging, and moved into place only once it is complete.").
 		Required().String()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := util.CancelOnInterrupt(context.Background())
+	defer stop()
+
+	opts.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:  progname,
+		Level: hclog.LevelFromString("INFO"),
+	})
+	inputSpec := backend.SchemeFile + ":" + *inputPath
+	scheme := backend.SchemeConsulExport
+	if *format == "txn" {
+		scheme = backend.SchemeConsulTxn
+	}
+	outputSpec := scheme + ":" + *outputPath
+
+	// Local output is staged, and committed once complete.
+	var output *stage.Stage
+	if strings.HasPrefix(*outputPath, backend.SchemeConsul+":") {
+		if *format == "txn" {
+			app.Fatalf("--format=txn writes payload files; it cannot be used with a consul:ADDR output")
+		}
+		outputSpec = *outputPath
+	} else {
+		output = stage.New(*outputPath)
+		if *checkpointPath == "" {
+			*checkpointPath = backend.CheckpointPath(*outputPath)
+		}
+		if !*force {
+			if err := checkEmpty(*outputPath); err != nil {
+				app.Fatalf("%v; use --force to replace it", err)
+			}
+		}
+	}
+	if *resume && *checkpointPath == "" {
+		app.Fatalf("--resume requires --checkpoint")
+	}
+
+	if opts.ConsulMaxValueSize > 0 {
+		if err := checkSizes(ctx, *inputPath, *masterKeyPath, filter, opts); err != nil {
+			if ctx.Err() != nil {
+				app.Fatalf("interrupted")
+			}
+			app.Fatalf("%v", err)
+		}
+	}
 
-	if err := convert(ctx, *inputPath, *outputPath, *consulPath); err != nil {
-		app.Fatalf("%v", err)
+	var cp *backend.Checkpoint
+	if *checkpointPath != "" {
+		var err error
+		if cp, err = backend.PrepareCheckpoint(*checkpointPath, *resume); err != nil {
+			app.Fatalf("%v", err)
+		}
+	}
+	stagedSpec := outputSpec
+	if output != nil {
+		if err := output.Prepare(cp != nil); err != nil {
+			app.Fatalf("%v", err)
+		}
+		stagedSpec = scheme + ":" + output.Path()
+	}
+	if err := convert(ctx, *inputPath, stagedSpec, *checkpointPath, cp, filter, opts); err != nil {
+		app.Fatalf("%v", interrupted(ctx, err, *checkpointPath))
+	}
+	if output != nil {
+		if err := commit(output, *outputPath); err != nil {
+			app.Fatalf("%v", err)
+		}
+	}
+	if *checkpointPath != "" {
+		if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
+			app.Fatalf("%v", err)
+		}
+	}
+	if *verify {
+		if err := verifyConversion(ctx, inputSpec, outputSpec, filter, opts); err != nil {
+			app.Fatalf("%v", err)
+		}
 	}
 }
 
-func convert(ctx context.Context, inputPath, outputPath, consulPath string) (err error) {
-	fb, openError := openFilesystemBackend(ctx, inputPath)
+// convert copies the input to outputSpec.  Unless checkpointPath is empty,
+// progress is recorded there.  If cp is not nil, the copy resumes from it.
+func convert(ctx context.Context, inputPath, outputSpec, checkpointPath string, cp *backend.Checkpoint, filter *backend.Filter, opts *backend.Options) (err error) {
+	if cp != nil {
+		sinkOpts := *opts
+		sinkOpts.Resume = &cp.Position
+		opts = &sinkOpts
+		fmt.Fprintf(os.Stderr, "%s: resuming after %d entries, from %s\n", progname, cp.Entries, cp.LastKey)
+	}
+
+	fb, openError := backend.NewFileBackend(inputPath, opts.Logger)
 	if openError != nil {
 		return openError
 	}
+	src := backend.NewPhysicalSource(ctx, fb, opts.Parallel)
 	defer func() {
-		if closeError := fb.Close(); closeError != nil && err == nil {
+		if closeError := src.Close(); closeError != nil && err == nil {
 			err = closeError
 		}
 	}()
 
-	cb, openError := openConsulBackend(outputPath, consulPath)
+	dst, openError := backend.OpenSink(ctx, outputSpec, opts)
 	if openError != nil {
 		return openError
 	}
 	defer func() {
-		if closeError := cb.Close(); closeError != nil && err == nil {
+		if closeError := dst.Close(); closeError != nil && err == nil {
 			err = closeError
 		}
 	}()
 
-conversion:
-	for {
-		ve, readError := fb.ReadEntry(ctx)
-		if readError != nil {
-			if readError == io.EOF {
-				break conversion
-			}
-			return readError
-		}
-
-		ce, conversionError := convertEntry(ve, consulPath)
-		if conversionError != nil {
-			return conversionError
-		}
-
-		if writeError := cb.WriteEntry(ce); writeError != nil {
-			return writeError
-		}
+	if checkpointPath == "" {
+		_, err = backend.Copy(ctx, dst, backend.FilterSource(src, filter))
+		return err
 	}
-	return nil
-}
-
-type filesystemBackend struct {
-	backend vault.Backend
-	walker  *filesystemWalker
+	_, err = backend.CopyWithCheckpoints(ctx, dst, backend.FilterSource(src, filter), checkpointPath, cp)
+	return err
 }
 
-func openFilesystemBackend(ctx context.Context, backendPath string) (*filesystemBackend, error) {
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name:  progname,
-		Level: hclog.LevelFromString("INFO"),
-	})
-
-	conf := map[string]string{"path": backendPath}
-
-	backend, err := file.NewFileBackend(conf, logger)
-	if err != nil {
-		return nil, err
+// checkEmpty returns an error if outputPath, or the first file of a split
+// export to outputPath, is not empty.
+func checkEmpty(outputPath string) error {
+	for _, p := range []string{outputPath, backend.SplitPath(outputPath, 1)} {
+		empty, err := stage.IsEmpty(p)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("%s is not empty", p)
+		}
 	}
-
-	return &filesystemBackend{
-		backend: backend,
-		walker:  newFilesystemWalker(ctx, backend, ""),
-	}, nil
-}
-
-func (be *filesystemBackend) Close() error {
 	return nil
 }
 
-func (be *filesystemBackend) ReadEntry(ctx context.Context) (*vault.Entry, error) {
-	key, err := be.walker.Next()
+// commit moves the staged output into place, then removes any files of an
+// earlier export to outputPath that were not replaced: the unsplit file, or
+// the excess files of a longer split series.
+func commit(output *stage.Stage, outputPath string) error {
+	paths, err := output.Commit()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if key == "" {
-		return nil, io.EOF
+	replaced := make(map[string]bool)
+	for _, p := range paths {
+		replaced[p] = true
 	}
-	return be.backend.Get(ctx, key)
-}
-
-type filesystemWalker struct {
-	backend vault.Backend
-	keys    chan string
-	err     error
-}
 
-func newFilesystemWalker(ctx context.Context, backend vault.Backend, root string) *filesystemWalker {
-	w := &filesystemWalker{
-		backend: backend,
-		keys:    make(chan string, 10),
-	}
-	go func() {
-		if err := w.walk(ctx, root); err != nil {
-			w.err = err
+	stale := []string{filepath.Clean(outputPath)}
+	for i := 1; ; i++ {
+		p := backend.SplitPath(filepath.Clean(outputPath), i)
+		if _, err := os.Stat(p); err != nil {
+			break
 		}
-		close(w.keys)
-	}()
-	return w
-}
-
-func (w *filesystemWalker) walk(ctx context.Context, prefix string) error {
-	keys, err := w.backend.List(ctx, prefix)
-	if err != nil {
-		return err
+		stale = append(stale, p)
 	}
-	sort.Strings(keys)
-
-	for _, k := range keys {
-		p := path.Join(prefix, k)
-
-		if k[len(k)-1:] == "/" {
-			if err := w.walk(ctx, p); err != nil {
-				return err
-			}
+	for _, p := range stale {
+		if replaced[p] {
 			continue
 		}
-
-		w.keys <- p
+		if err := os.RemoveAll(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
 
-func (w *filesystemWalker) Next() (string, error) {
-	var (
-		key string
-		err error
-	)
-
-	select {
-	case k, ok := <-w.keys:
-		key = k
-		// Let the caller flush the channel before we propagate a pending error.
-		if !ok {
-			err = w.err
-		}
+// interrupted rewrites err to explain how to resume, if a checkpoint was
+// left behind.
+func interrupted(ctx context.Context, err error, checkpointPath string) error {
+	if ctx.Err() != nil {
+		err = errors.New("interrupted")
 	}
-	return key, err
-}
-
-type consulBackend struct {
-	file      io.WriteCloser
-	buffer    *bytes.Buffer
-	keyPrefix string
+	if checkpointPath == "" {
+		return err
+	}
+	if _, statError := os.Stat(checkpointPath); statError == nil {
+		return fmt.Errorf("%v; run again with --resume to continue from %s", err, checkpointPath)
+	}
+	return err
 }
 
-func openConsulBackend(backendPath, consulPath string) (*consulBackend, error) {
-	keyPrefix := path.Clean(consulPath)
-	if keyPrefix == "/" || keyPrefix == "." {
-		return nil, fmt.Errorf("invalid Consul path: %v", consulPath)
+// checkSizes reads every value of the input and lists those larger than
+// the Consul value size limit.  An error is returned if there are any.
+func checkSizes(ctx context.Context, inputPath, masterKeyPath string, filter *backend.Filter, opts *backend.Options) error {
+	fb, err := backend.NewFileBackend(inputPath, opts.Logger)
+	if err != nil {
+		return err
 	}
-
-	f, err := os.OpenFile(backendPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	src := backend.NewPhysicalSource(ctx, fb, opts.Parallel)
+	_, oversize, err := backend.CheckSizes(ctx, backend.FilterSource(src, filter), opts.ConsulMaxValueSize)
+	src.Close() // nolint: errcheck
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	be := &consulBackend{
-		file:      f,
-		buffer:    &bytes.Buffer{},
-		keyPrefix: keyPrefix,
+	if len(oversize) == 0 {
+		return nil
 	}
 
-	if err := be.writeHeader(); err != nil {
-		f.Close() // nolint: errcheck
-		return nil, err
+	var mounts mounttable.Table
+	if masterKeyPath != "" {
+		mounts, err = loadMounts(ctx, fb, masterKeyPath)
+		if err != nil {
+			return err
+		}
 	}
-	return be, nil
-}
 
-func (be *consulBackend) Close() error {
-	if err := be.writeTrailer(); err != nil {
-		return err
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tKEY\tLOGICAL PATH")
+	for _, o := range oversize {
+		logical := "-"
+		if mounts != nil {
+			logical = mounts.LogicalPath(o.Key)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", o.Size, o.Key, logical)
 	}
-	if err := be.flush(); err != nil {
+	if err := tw.Flush(); err != nil {
 		return err
 	}
-	return be.file.Close()
+	return fmt.Errorf("%d entries exceed the Consul value size limit of %d bytes; nothing was written", len(oversize), opts.ConsulMaxValueSize)
 }
 
-func (be *consulBackend) WriteEntry(entry *consul.Entry) error {
-	if err := be.flush(); err != nil {
-		return err
+// loadMounts unseals the input's barrier to read its mount tables.
+func loadMounts(ctx context.Context, fb physical.Backend, masterKeyPath string) (mounttable.Table, error) {
+	f, err := ioutil.ReadFile(masterKeyPath)
+	if err != nil {
+		return nil, err
 	}
-
-	compacted, err := json.Marshal(entry)
+	masterKey, err := util.DecodeKeyBase64Byte(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer util.Zeroize(masterKey)
 
-	be.buffer.WriteString("\t")
-	if err := json.Indent(be.buffer, compacted, "\t", "\t"); err != nil {
-		return err
+	barrier, err := vault.NewAESGCMBarrier(fb)
+	if err != nil {
+		return nil, err
 	}
-	be.buffer.WriteString(",\n")
-	return nil
-}
-
-func (be *consulBackend) flush() error {
-	if be.buffer.Len() > 0 {
-		if _, err := be.buffer.WriteTo(be.file); err != nil {
-			return err
-		}
-		be.buffer.Reset()
+	if err := barrier.Unseal(ctx, masterKey); err != nil {
+		return nil, err
 	}
-	return nil
-}
+	defer barrier.Seal() // nolint: errcheck
 
-func (be *consulBackend) writeHeader() error {
-	be.buffer.WriteString("[\n")
-	return nil
+	return mounttable.Load(ctx, barrier)
 }
 
-func (be *consulBackend) writeTrailer() error {
-	// Remove trailing JSON element sequence separator and newline.
-	l := be.buffer.Len()
-	if l >= 2 {
-		be.buffer.Truncate(l - 2)
+func verifyConversion(ctx context.Context, inputSpec, outputSpec string, filter *backend.Filter, opts *backend.Options) error {
+	n, mismatches, err := backend.VerifySpecs(ctx, inputSpec, outputSpec, filter, opts)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	for _, m := range mismatches {
+		fmt.Fprintln(os.Stderr, m)
 	}
-	be.buffer.WriteString("\n]\n")
+	if len(mismatches) > 0 {
+		return fmt.Errorf("verify: %d mismatched keys", len(mismatches))
+	}
+	fmt.Fprintf(os.Stderr, "%s: verified %d entries\n", progname, n)
 	return nil
 }
-
-func convertEntry(entry *vault.Entry, keyPrefix string) (*consul.Entry, error) {
-	return &consul.Entry{
-		Key:   keyAddPrefix(entry.Key, keyPrefix),
-		Value: base64.StdEncoding.EncodeToString(entry.Value),
-	}, nil
-}
-
-func keyAddPrefix(key, prefix string) string {
-	if prefix == "" {
-		return key
-	}
-	pe := strings.Split(prefix, "/")
-	ke := strings.Split(key, "/")
-	elems := make([]string, 0, len(pe)+len(ke))
-	elems = append(elems, pe...)
-	elems = append(elems, ke...)
-	return strings.Join(elems, "/")
-}
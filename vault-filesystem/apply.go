@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// manifestOp is a single operation in an apply manifest.  Put operations
+// take their data from exactly one of Value, ValueBase64 or File.
+type manifestOp struct {
+	Op          string `json:"op" yaml:"op"`
+	Key         string `json:"key" yaml:"key"`
+	Value       string `json:"value,omitempty" yaml:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty" yaml:"value_base64,omitempty"`
+	// File is interpreted relative to the directory containing the manifest.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// Compression is one of none, lzw, gzip or snappy.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// GzipLevel is one of speed, default or best.
+	GzipLevel string `json:"gzip_level,omitempty" yaml:"gzip_level,omitempty"`
+}
+
+// readManifest parses a JSON or YAML list of operations.  Files named *.json
+// are parsed as JSON; anything else is parsed as YAML.
+func readManifest(manifestPath string) ([]*manifestOp, error) {
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []*manifestOp
+	if filepath.Ext(manifestPath) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&ops)
+	} else {
+		err = yaml.UnmarshalStrict(buf, &ops)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestPath, err)
+	}
+	return ops, nil
+}
+
+// apply encrypts every operation in a manifest up front, then submits them
+// to the physical backend as a single transaction.  Backends that lack
+// native transactions, such as the filesystem backend, have earlier
+// operations rolled back if a later one fails.
+func apply(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, manifestPath string, dryRun bool) error {
+	ops, err := readManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	txns := make([]*physical.TxnEntry, 0, len(ops))
+	for i, op := range ops {
+		txn, err := op.txnEntry(ctx, barrier, filepath.Dir(manifestPath))
+		if err != nil {
+			return fmt.Errorf("operation %d: %v", i+1, err)
+		}
+		txns = append(txns, txn)
+	}
+
+	for _, txn := range txns {
+		fmt.Fprintf(os.Stderr, "%s: %s %s\n", progname, txn.Operation, txn.Entry.Key)
+	}
+	if dryRun || len(txns) == 0 {
+		return nil
+	}
+
+	return transact(ctx, backend, txns)
+}
+
+func (op *manifestOp) txnEntry(ctx context.Context, barrier *vault.AESGCMBarrier, dir string) (*physical.TxnEntry, error) {
+	key := op.Key
+	if key == "" {
+		return nil, errors.New("missing key")
+	}
+	if key == keyringPath || unencryptedKeys[key] {
+		return nil, fmt.Errorf("%s is not encrypted by the barrier keyring", key)
+	}
+
+	switch physical.Operation(op.Op) {
+	case physical.DeleteOperation:
+		if op.Value != "" || op.ValueBase64 != "" || op.File != "" {
+			return nil, fmt.Errorf("%s: delete takes no data", key)
+		}
+		return &physical.TxnEntry{
+			Operation: physical.DeleteOperation,
+			Entry:     &physical.Entry{Key: key},
+		}, nil
+
+	case physical.PutOperation:
+		value, err := op.data(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+
+		compression := op.Compression
+		if compression == "" {
+			compression = compressionTypeNone
+		}
+		if !strutil.StrListContains(compressionTypes, compression) {
+			return nil, fmt.Errorf("%s: unknown compression: %s", key, compression)
+		}
+		gzipLevel := op.GzipLevel
+		if gzipLevel == "" {
+			gzipLevel = "best"
+		}
+		if _, ok := gzipLevels[gzipLevel]; !ok {
+			return nil, fmt.Errorf("%s: unknown gzip level: %s", key, gzipLevel)
+		}
+
+		value, err = compress(value, compressionConfig(compression, gzipLevel))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		ciphertext, err := barrier.Encrypt(ctx, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		return &physical.TxnEntry{
+			Operation: physical.PutOperation,
+			Entry: &physical.Entry{
+				Key:   key,
+				Value: ciphertext,
+			},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%s: unknown operation: %q", key, op.Op)
+	}
+}
+
+func (op *manifestOp) data(dir string) ([]byte, error) {
+	var sources int
+	for _, s := range []string{op.Value, op.ValueBase64, op.File} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, errors.New("put requires exactly one of value, value_base64 or file")
+	}
+
+	switch {
+	case op.ValueBase64 != "":
+		return base64.StdEncoding.DecodeString(op.ValueBase64)
+	case op.File != "":
+		p := op.File
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		return ioutil.ReadFile(p)
+	default:
+		return []byte(op.Value), nil
+	}
+}
+
+// transact runs txns as a single unit against backend.
+func transact(ctx context.Context, backend physical.Backend, txns []*physical.TxnEntry) error {
+	switch b := backend.(type) {
+	case physical.Transactional:
+		return b.Transaction(ctx, txns)
+	case physical.PseudoTransactional:
+		return physical.GenericTransactionHandler(ctx, b, txns)
+	default:
+		return errors.New("storage backend does not support transactions")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/layout"
+)
+
+// Vault stores a small number of entries beneath the barrier's namespace
+// without encrypting them under the barrier keyring.  Walking the barrier
+// will encounter these keys; they must be handled separately.
+const keyringPath = layout.KeyringPath
+
+var unencryptedKeys = layout.UnencryptedKeys
+
+// decryptValue decrypts a physical ciphertext read from key.  Unlike
+// AESGCMBarrier.Decrypt, decryptValue understands the entries that Vault
+// stores outside of the barrier keyring.
+func decryptValue(ctx context.Context, barrier *vault.AESGCMBarrier, key string, ciphertext []byte) ([]byte, error) {
+	switch {
+	case unencryptedKeys[key]:
+		return ciphertext, nil
+
+	case key == keyringPath:
+		keyring, err := barrier.Keyring()
+		if err != nil {
+			return nil, err
+		}
+		return decryptWithKey(keyring.MasterKey(), key, ciphertext)
+
+	default:
+		return barrier.Decrypt(ctx, key, ciphertext)
+	}
+}
+
+// getPlaintext reads the value at key directly from the physical backend.
+// Both the ciphertext and the decrypted, decompressed plaintext are
+// returned.  A nil ciphertext indicates that no value exists at key.
+func getPlaintext(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, key string) (ciphertext, plaintext []byte, err error) {
+	pe, err := backend.Get(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", key, err)
+	}
+	if pe == nil {
+		return nil, nil, nil
+	}
+
+	plaintext, err = decryptValue(ctx, barrier, key, pe.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", key, err)
+	}
+	plaintext, err = decompress(plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return pe.Value, plaintext, nil
+}
+
+// decryptWithKey opens an AES-GCM barrier ciphertext with an explicit key,
+// bypassing the keyring term lookup.
+func decryptWithKey(key []byte, path string, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < layout.HeaderSize+gcm.Overhead() {
+		return nil, fmt.Errorf("%s: %v", path, layout.ErrShortCiphertext)
+	}
+	h, err := layout.ParseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	sealed := ciphertext[layout.HeaderSize:]
+
+	switch h.Version {
+	case vault.AESGCMVersion1:
+		return gcm.Open(nil, h.Nonce, sealed, nil)
+	case vault.AESGCMVersion2:
+		return gcm.Open(nil, h.Nonce, sealed, []byte(path))
+	default:
+		return nil, fmt.Errorf("%s: unknown barrier version %#x", path, h.Version)
+	}
+}
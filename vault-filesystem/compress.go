@@ -0,0 +1,138 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/compressutil"
+)
+
+const compressionTypeNone = "none"
+
+var compressionTypes = []string{
+	compressionTypeNone,
+	compressutil.CompressionTypeLzw,
+	compressutil.CompressionTypeGzip,
+	compressutil.CompressionTypeSnappy,
+}
+
+// Gzip compression levels accepted by compressutil.  Other levels are
+// silently replaced with the default.
+var gzipLevels = map[string]int{
+	"speed":   gzip.BestSpeed,
+	"default": gzip.DefaultCompression,
+	"best":    gzip.BestCompression,
+}
+
+var gzipLevelNames = []string{"speed", "default", "best"}
+
+// compressionConfig builds a compressutil configuration from command line
+// flag values.  A nil configuration disables compression.
+func compressionConfig(typ, gzipLevel string) *compressutil.CompressionConfig {
+	if typ == compressionTypeNone || typ == "" {
+		return nil
+	}
+	cfg := &compressutil.CompressionConfig{Type: typ}
+	if typ == compressutil.CompressionTypeGzip {
+		cfg.GzipCompressionLevel = gzipLevels[gzipLevel]
+	}
+	return cfg
+}
+
+// compress applies cfg to value.  A nil configuration returns value
+// unmodified.
+func compress(value []byte, cfg *compressutil.CompressionConfig) ([]byte, error) {
+	if cfg == nil {
+		return value, nil
+	}
+	// compressutil.Compress may rewrite the configuration it is given.
+	c := *cfg
+	return compressutil.Compress(value, &c)
+}
+
+func sameCompression(a, b *compressutil.CompressionConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type != b.Type {
+		return false
+	}
+	return a.Type != compressutil.CompressionTypeGzip || a.GzipCompressionLevel == b.GzipCompressionLevel
+}
+
+// describeCompression returns a human-readable description of cfg,
+// including the canary byte that marks values compressed with it.
+func describeCompression(cfg *compressutil.CompressionConfig) string {
+	switch cfg.Type {
+	case compressutil.CompressionTypeGzip:
+		level := "default"
+		for name, l := range gzipLevels {
+			if l == cfg.GzipCompressionLevel {
+				level = name
+			}
+		}
+		return fmt.Sprintf("gzip, %s level (canary %q)", level, compressutil.CompressionCanaryGzip)
+	case compressutil.CompressionTypeLzw:
+		return fmt.Sprintf("lzw (canary %q)", compressutil.CompressionCanaryLzw)
+	case compressutil.CompressionTypeSnappy:
+		return fmt.Sprintf("snappy (canary %q)", compressutil.CompressionCanarySnappy)
+	default:
+		return cfg.Type
+	}
+}
+
+// gzipXFLOffset is the offset of the extra flags byte in a gzip member
+// header.  See RFC 1952, section 2.3.
+const gzipXFLOffset = 8
+
+// detectCompression inspects value for a compressutil canary byte.  The
+// configuration that reproduces the compression is returned alongside the
+// decompressed value.  A nil configuration indicates that value was not
+// compressed.
+func detectCompression(value []byte) (*compressutil.CompressionConfig, []byte, error) {
+	if len(value) == 0 {
+		return nil, value, nil
+	}
+	decompressed, notCompressed, err := compressutil.Decompress(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if notCompressed {
+		return nil, value, nil
+	}
+
+	cfg := &compressutil.CompressionConfig{}
+	switch value[0] {
+	case compressutil.CompressionCanaryGzip:
+		cfg.Type = compressutil.CompressionTypeGzip
+		cfg.GzipCompressionLevel = gzipLevel(value[1:])
+	case compressutil.CompressionCanaryLzw:
+		cfg.Type = compressutil.CompressionTypeLzw
+	case compressutil.CompressionCanarySnappy:
+		cfg.Type = compressutil.CompressionTypeSnappy
+	}
+	return cfg, decompressed, nil
+}
+
+// decompress returns the decompressed form of value, or value itself if it
+// was not compressed.
+func decompress(value []byte) ([]byte, error) {
+	_, decompressed, err := detectCompression(value)
+	return decompressed, err
+}
+
+// gzipLevel recovers an approximate compression level from the extra flags
+// recorded in a gzip header by compress/flate.
+func gzipLevel(member []byte) int {
+	if len(member) <= gzipXFLOffset {
+		return gzip.DefaultCompression
+	}
+	switch member[gzipXFLOffset] {
+	case 2:
+		return gzip.BestCompression
+	case 4:
+		return gzip.BestSpeed
+	default:
+		return gzip.DefaultCompression
+	}
+}
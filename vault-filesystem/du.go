@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/mounttable"
+)
+
+type usage struct {
+	Entries         int
+	CiphertextBytes int64
+	PlaintextBytes  int64
+}
+
+func (u *usage) add(stat *entryStat) {
+	u.Entries++
+	u.CiphertextBytes += int64(stat.CiphertextSize)
+	u.PlaintextBytes += int64(stat.PlaintextSize)
+}
+
+type mountUsage struct {
+	usage
+	Path string
+	Type string
+}
+
+type sizedEntry struct {
+	Key  string
+	Path string
+	*entryStat
+}
+
+func du(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, prefix string, top int) error {
+	mounts, err := mounttable.Load(ctx, barrier)
+	if err != nil {
+		return err
+	}
+
+	var (
+		total    usage
+		prefixes = make(map[string]*usage)
+		byMount  = make(map[string]*mountUsage)
+		largest  []*sizedEntry
+		skipped  unreadable
+	)
+
+	err = walk(ctx, barrier, prefix, true, func(key string, depth int) error {
+		if isSubtree(key) {
+			return nil
+		}
+
+		stat, err := statEntry(ctx, backend, barrier, key)
+		if err != nil {
+			return skipped.skip(ctx, err)
+		}
+
+		total.add(stat)
+
+		tl := topLevelPrefix(key)
+		if prefixes[tl] == nil {
+			prefixes[tl] = &usage{}
+		}
+		prefixes[tl].add(stat)
+
+		var label, typ string
+		if m, _ := mounts.Resolve(key); m != nil {
+			label, typ = m.Path, m.Type
+		} else if orphan, ok := mounttable.OrphanPrefix(key); ok {
+			label, typ = orphan, "(unmounted)"
+		}
+		if label != "" {
+			if byMount[label] == nil {
+				byMount[label] = &mountUsage{Path: label, Type: typ}
+			}
+			byMount[label].add(stat)
+		}
+
+		if top > 0 {
+			largest = append(largest, &sizedEntry{
+				Key:       key,
+				Path:      mounts.LogicalPath(key),
+				entryStat: stat,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tENTRIES\tCIPHERTEXT\tPLAINTEXT")
+	for _, p := range sortedUsageKeys(prefixes) {
+		printUsage(tw, p, prefixes[p])
+	}
+	printUsage(tw, "total", &total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(byMount) > 0 {
+		fmt.Fprintln(w)
+		mus := make([]*mountUsage, 0, len(byMount))
+		for _, mu := range byMount {
+			mus = append(mus, mu)
+		}
+		sort.Slice(mus, func(i, j int) bool {
+			if mus[i].CiphertextBytes != mus[j].CiphertextBytes {
+				return mus[i].CiphertextBytes > mus[j].CiphertextBytes
+			}
+			return mus[i].Path < mus[j].Path
+		})
+
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "MOUNT\tTYPE\tENTRIES\tCIPHERTEXT\tPLAINTEXT")
+		for _, mu := range mus {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", mu.Path, mu.Type, mu.Entries, mu.CiphertextBytes, mu.PlaintextBytes)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(largest) > 0 {
+		fmt.Fprintln(w)
+		sort.SliceStable(largest, func(i, j int) bool {
+			return largest[i].CiphertextSize > largest[j].CiphertextSize
+		})
+		if len(largest) > top {
+			largest = largest[:top]
+		}
+
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tPATH\tCIPHERTEXT\tPLAINTEXT")
+		for _, e := range largest {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", e.Key, e.Path, e.CiphertextSize, e.PlaintextSize)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	// Unreadable entries are left out of every total.
+	return skipped.err()
+}
+
+func printUsage(w io.Writer, label string, u *usage) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", label, u.Entries, u.CiphertextBytes, u.PlaintextBytes)
+}
+
+func sortedUsageKeys(m map[string]*usage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// topLevelPrefix returns the first element of key, including its trailing
+// slash if key lies within a subtree.
+func topLevelPrefix(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+)
+
+// tmpfsDirs are candidate locations for decrypted scratch files, in order of
+// preference.  Memory-backed filesystems keep plaintext off persistent
+// storage.
+var tmpfsDirs = []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm", "/run/shm"}
+
+// edit decrypts the value at key into a private scratch file and opens it in
+// the user's editor.  Any changes are re-compressed with the algorithm found
+// in the original value, then encrypted and written back.
+func edit(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, key string) error {
+	if key == keyringPath || unencryptedKeys[key] {
+		return fmt.Errorf("%s is not encrypted by the barrier keyring and cannot be edited", key)
+	}
+
+	pe, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if pe == nil {
+		return fmt.Errorf("no value at %s", key)
+	}
+	plaintext, err := barrier.Decrypt(ctx, key, pe.Value)
+	if err != nil {
+		return err
+	}
+	cfg, original, err := detectCompression(plaintext)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(scratchDir(), progname)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	name := path.Base(key)
+	isJSON := json.Valid(original)
+	if isJSON {
+		name += ".json"
+	}
+	scratch := filepath.Join(dir, name)
+	defer shred(scratch)
+
+	if err := ioutil.WriteFile(scratch, original, 0600); err != nil {
+		return err
+	}
+	if err := runEditor(scratch); err != nil {
+		return err
+	}
+
+	edited, err := ioutil.ReadFile(scratch)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(original, edited) {
+		fmt.Fprintf(os.Stderr, "%s: no changes to %s\n", progname, key)
+		return nil
+	}
+	if isJSON && !json.Valid(edited) {
+		return errors.New("edited data is no longer valid JSON; discarding changes")
+	}
+
+	value, err := compress(edited, cfg)
+	if err != nil {
+		return err
+	}
+
+	current, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == nil || !bytes.Equal(current.Value, pe.Value) {
+		return fmt.Errorf("%s was modified by another process while being edited; discarding changes", key)
+	}
+
+	return barrier.Put(ctx, &vault.Entry{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func scratchDir() string {
+	for _, d := range tmpfsDirs {
+		if d == "" {
+			continue
+		}
+		if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+			return d
+		}
+	}
+	return os.TempDir()
+}
+
+func runEditor(file string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// Defer to the shell so that editor may carry its own arguments.
+	cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", file)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// shred overwrites a scratch file with zeroes before removing it.  Editors
+// that replace rather than rewrite files defeat this; the enclosing private
+// directory is removed regardless.
+func shred(file string) {
+	if fi, err := os.Stat(file); err == nil {
+		ioutil.WriteFile(file, make([]byte, fi.Size()), 0600) // nolint: errcheck
+	}
+	os.Remove(file) // nolint: errcheck
+}
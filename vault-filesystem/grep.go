@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/mounttable"
+)
+
+// compilePattern builds a regular expression from a grep pattern.
+func compilePattern(pattern string, fixed, ignoreCase bool) (*regexp.Regexp, error) {
+	if fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// grep searches the decrypted, decompressed value of every entry below
+// prefix.  Each match is printed alongside its barrier key and up to
+// contextBytes bytes of surrounding plaintext.  If pathsOnly is set, grep
+// instead prints the logical path of each matching entry once.  Entries
+// that cannot be read are reported and skipped; an error is returned once
+// the search is complete.
+func grep(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, re *regexp.Regexp, prefix string, contextBytes int, pathsOnly bool) (matched bool, err error) {
+	var mounts mounttable.Table
+	if pathsOnly {
+		mounts, err = mounttable.Load(ctx, barrier)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var skipped unreadable
+	err = walk(ctx, barrier, prefix, true, func(key string, depth int) error {
+		if isSubtree(key) {
+			return nil
+		}
+
+		_, plaintext, err := getPlaintext(ctx, backend, barrier, key)
+		if err != nil {
+			return skipped.skip(ctx, err)
+		}
+
+		if pathsOnly {
+			if re.Match(plaintext) {
+				matched = true
+				fmt.Println(mounts.LogicalPath(key))
+			}
+			return nil
+		}
+
+		for _, loc := range re.FindAllIndex(plaintext, -1) {
+			matched = true
+			start, end := loc[0]-contextBytes, loc[1]+contextBytes
+			if start < 0 {
+				start = 0
+			}
+			if end > len(plaintext) {
+				end = len(plaintext)
+			}
+			fmt.Printf("%s: %q\n", key, plaintext[start:end])
+		}
+		return nil
+	})
+	if err != nil {
+		return matched, err
+	}
+	return matched, skipped.err()
+}
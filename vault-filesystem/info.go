@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/helper/pgpkeys"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/mounttable"
+	"github.com/saj/vault-tools/internal/util"
+)
+
+// Paths consulted by info.  See vault/barrier.go, vault/seal.go,
+// vault/core.go, vault/token_store.go, vault/expiration.go and
+// helper/storagepacker.
+const (
+	barrierInitPath      = "barrier/init"
+	sealConfigPath       = "core/seal-config"
+	recoveryConfigPath   = "core/recovery-config"
+	keyringCanaryPath    = "core/canary-keyring"
+	tokenLookupPrefix    = "sys/token/id/"
+	leaseLookupPrefix    = "sys/expire/id/"
+	entityBucketsSubPath = "packer/buckets/"
+	groupBucketsSubPath  = "packer/group/buckets/"
+	identityMountType    = "identity"
+)
+
+// info prints a summary of the storage backend.  If barrier is nil, only the
+// details that can be read without the master key are shown.
+func info(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	initialized, err := exists(ctx, backend, keyringPath, barrierInitPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "Initialized:\t%t\n", initialized)
+
+	for _, c := range []struct {
+		label string
+		key   string
+	}{
+		{"Seal", sealConfigPath},
+		{"Recovery seal", recoveryConfigPath},
+	} {
+		if err := printSealConfig(ctx, tw, backend, c.label, c.key); err != nil {
+			return err
+		}
+	}
+
+	canary, err := exists(ctx, backend, keyringCanaryPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "Keyring canary:\t%t\n", canary)
+
+	tokens, err := countKeys(ctx, backend, tokenLookupPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "Tokens:\t%d\n", tokens)
+	leases, err := countKeys(ctx, backend, leaseLookupPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "Leases:\t%d\n", leases)
+
+	if barrier == nil {
+		fmt.Fprintf(tw, "\nSupply the master key for keyring, mount and identity details.\n")
+		return tw.Flush()
+	}
+
+	if err := printKeyring(ctx, tw, backend, barrier); err != nil {
+		return err
+	}
+	if err := printMountCounts(ctx, tw, backend, barrier); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func printSealConfig(ctx context.Context, w io.Writer, backend physical.Backend, label, key string) error {
+	pe, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if pe == nil {
+		fmt.Fprintf(w, "%s:\tnot configured\n", label)
+		return nil
+	}
+
+	conf := &vault.SealConfig{}
+	if err := jsonutil.DecodeJSON(pe.Value, conf); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	fmt.Fprintf(w, "%s:\t%s, %d of %d shares, %d stored\n", label, conf.Type, conf.SecretThreshold, conf.SecretShares, conf.StoredShares)
+	for i, k := range conf.PGPKeys {
+		fp := "unparseable key"
+		if fps, err := pgpkeys.GetFingerprints([]string{k}, nil); err == nil {
+			fp = fps[0]
+		}
+		fmt.Fprintf(w, "  PGP key %d:\t%s\n", i+1, fp)
+	}
+	return nil
+}
+
+func printKeyring(ctx context.Context, w io.Writer, backend physical.Backend, barrier *vault.AESGCMBarrier) error {
+	_, plaintext, err := getPlaintext(ctx, backend, barrier, keyringPath)
+	if err != nil {
+		return err
+	}
+	defer util.Zeroize(plaintext)
+
+	enc := &vault.EncodedKeyring{}
+	if err := jsonutil.DecodeJSON(plaintext, enc); err != nil {
+		return fmt.Errorf("%s: %v", keyringPath, err)
+	}
+	util.Zeroize(enc.MasterKey)
+	var active uint32
+	for _, k := range enc.Keys {
+		if k.Term > active {
+			active = k.Term
+		}
+		util.Zeroize(k.Value)
+	}
+
+	fmt.Fprintf(w, "Active term:\t%d\n", active)
+	fmt.Fprintf(w, "Terms:\t%d\n", len(enc.Keys))
+	return nil
+}
+
+func printMountCounts(ctx context.Context, w io.Writer, backend physical.Backend, barrier *vault.AESGCMBarrier) error {
+	mounts, err := mounttable.Load(ctx, barrier)
+	if err != nil {
+		return err
+	}
+
+	var secrets, creds int
+	var identity *mounttable.Mount
+	for _, m := range mounts {
+		if strings.HasPrefix(m.Path, mounttable.CredentialRoutePrefix) {
+			creds++
+		} else {
+			secrets++
+		}
+		if m.Type == identityMountType {
+			identity = m
+		}
+	}
+	fmt.Fprintf(w, "Secret mounts:\t%d\n", secrets)
+	fmt.Fprintf(w, "Auth mounts:\t%d\n", creds)
+
+	if identity == nil {
+		fmt.Fprintf(w, "Identity:\tnot mounted\n")
+		return nil
+	}
+	entities, err := countKeys(ctx, backend, identity.BarrierPrefix+entityBucketsSubPath)
+	if err != nil {
+		return err
+	}
+	groups, err := countKeys(ctx, backend, identity.BarrierPrefix+groupBucketsSubPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Entity buckets:\t%d\n", entities)
+	fmt.Fprintf(w, "Group buckets:\t%d\n", groups)
+	return nil
+}
+
+// exists reports whether any of keys holds a value.
+func exists(ctx context.Context, backend physical.Backend, keys ...string) (bool, error) {
+	for _, key := range keys {
+		pe, err := backend.Get(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if pe != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// countKeys counts the entries below prefix.  Counting needs only the
+// physical backend.
+func countKeys(ctx context.Context, backend physical.Backend, prefix string) (int, error) {
+	var n int
+	err := walk(ctx, backend, prefix, true, func(key string, depth int) error {
+		if !isSubtree(key) {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/journal"
+)
+
+// Verify journaledBackend satisfies the interfaces used by apply.
+var _ physical.PseudoTransactional = (*journaledBackend)(nil)
+
+// journaledBackend wraps a physical backend and appends a journal record for
+// every modification made through it.  Sitting beneath the barrier, it sees
+// every write regardless of which command made it, including the individual
+// steps and rollbacks of a pseudo-transaction.  Each record is appended
+// before the modification is made; if it cannot be, the modification is
+// refused.  A value that cannot be decrypted does not prevent its
+// modification.
+type journaledBackend struct {
+	physical.Backend
+	journal *journal.Journal
+	// barrier decrypts old and new values so that the journal may
+	// authenticate plaintext.  It is set once the barrier is unsealed;
+	// writes made while unsealing, such as a keyring upgrade, are
+	// journaled as stored.  The barrier cannot decrypt until then.
+	barrier *vault.AESGCMBarrier
+}
+
+func (b *journaledBackend) Put(ctx context.Context, entry *physical.Entry) error {
+	return b.put(ctx, entry, b.Backend.Get, b.Backend.Put)
+}
+
+func (b *journaledBackend) Delete(ctx context.Context, key string) error {
+	return b.delete(ctx, key, b.Backend.Get, b.Backend.Delete)
+}
+
+func (b *journaledBackend) GetInternal(ctx context.Context, key string) (*physical.Entry, error) {
+	return b.pseudoTransactional().GetInternal(ctx, key)
+}
+
+func (b *journaledBackend) PutInternal(ctx context.Context, entry *physical.Entry) error {
+	pt := b.pseudoTransactional()
+	return b.put(ctx, entry, pt.GetInternal, pt.PutInternal)
+}
+
+func (b *journaledBackend) DeleteInternal(ctx context.Context, key string) error {
+	pt := b.pseudoTransactional()
+	return b.delete(ctx, key, pt.GetInternal, pt.DeleteInternal)
+}
+
+func (b *journaledBackend) pseudoTransactional() physical.PseudoTransactional {
+	// openBackend only ever returns a FileBackend, which is
+	// PseudoTransactional.
+	return b.Backend.(physical.PseudoTransactional)
+}
+
+type getFunc func(context.Context, string) (*physical.Entry, error)
+
+func (b *journaledBackend) put(ctx context.Context, entry *physical.Entry, get getFunc, put func(context.Context, *physical.Entry) error) error {
+	old, err := b.current(ctx, get, entry.Key)
+	if err != nil {
+		return err
+	}
+	if err := b.append(journal.OperationPut, entry.Key, old, b.value(ctx, entry.Key, entry.Value)); err != nil {
+		return err
+	}
+	if err := put(ctx, entry); err != nil {
+		return b.abort(entry.Key, err)
+	}
+	return nil
+}
+
+func (b *journaledBackend) delete(ctx context.Context, key string, get getFunc, del func(context.Context, string) error) error {
+	old, err := b.current(ctx, get, key)
+	if err != nil {
+		return err
+	}
+	if err := b.append(journal.OperationDelete, key, old, journal.Value{}); err != nil {
+		return err
+	}
+	if err := del(ctx, key); err != nil {
+		return b.abort(key, err)
+	}
+	return nil
+}
+
+func (b *journaledBackend) append(operation, key string, oldValue, newValue journal.Value) error {
+	if b.journal == nil {
+		return fmt.Errorf("journal: %s: journal is not open", key)
+	}
+	if err := b.journal.Append(operation, key, oldValue, newValue); err != nil {
+		return fmt.Errorf("journal: %s: %v", key, err)
+	}
+	return nil
+}
+
+// abort records that a modification of key failed with err, and returns err.
+func (b *journaledBackend) abort(key string, err error) error {
+	if abortError := b.append(journal.OperationAbort, key, journal.Value{}, journal.Value{}); abortError != nil {
+		return fmt.Errorf("%v; %v", err, abortError)
+	}
+	return err
+}
+
+// current returns the value stored at key, for the journal.
+func (b *journaledBackend) current(ctx context.Context, get getFunc, key string) (journal.Value, error) {
+	pe, err := get(ctx, key)
+	if err != nil {
+		return journal.Value{}, err
+	}
+	if pe == nil {
+		return journal.Value{}, nil
+	}
+	return b.value(ctx, key, pe.Value), nil
+}
+
+// value returns the decompressed plaintext of a ciphertext, so that the
+// journal reflects a change in content rather than a change in encoding.  A
+// ciphertext that cannot be decrypted, such as a corrupt entry being
+// repaired, is journaled as stored.
+func (b *journaledBackend) value(ctx context.Context, key string, ciphertext []byte) journal.Value {
+	if b.barrier == nil {
+		return journal.Value{Data: ciphertext, Stored: true}
+	}
+	plaintext, err := decryptValue(ctx, b.barrier, key, ciphertext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: journal: %s: %v; recording the value as stored\n", progname, key, err)
+		return journal.Value{Data: ciphertext, Stored: true}
+	}
+	// A raw value may begin with a compression canary by chance; it is
+	// journaled as it is.
+	if decompressed, err := decompress(plaintext); err == nil {
+		plaintext = decompressed
+	}
+	return journal.Value{Data: plaintext}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+)
+
+const (
+	listFormatPlain = "plain"
+	listFormatTree  = "tree"
+	listFormatJSON  = "json"
+)
+
+var listFormats = []string{listFormatPlain, listFormatTree, listFormatJSON}
+
+type listEntry struct {
+	Key string `json:"key"`
+	*entryStat
+}
+
+func list(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, prefix string, recursive bool, format string, sizes bool) error {
+	prefix = normalisePrefix(prefix)
+
+	var (
+		entries []*listEntry
+		depths  []int
+		skipped unreadable
+	)
+	err := walk(ctx, barrier, prefix, recursive, func(key string, depth int) error {
+		// Subtrees are implied by the full keys printed in recursive plain
+		// and JSON output.
+		if recursive && isSubtree(key) && format != listFormatTree {
+			return nil
+		}
+
+		e := &listEntry{Key: key}
+		if sizes && !isSubtree(key) {
+			stat, err := statEntry(ctx, backend, barrier, key)
+			if err != nil {
+				if err := skipped.skip(ctx, err); err != nil {
+					return err
+				}
+			}
+			e.entryStat = stat
+		}
+		entries = append(entries, e)
+		depths = append(depths, depth)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case listFormatJSON:
+		if entries == nil {
+			entries = []*listEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(entries)
+
+	case listFormatTree:
+		err = printListing(os.Stdout, entries, sizes, func(i int) string {
+			return strings.Repeat("  ", depths[i]) + baseName(entries[i].Key)
+		})
+
+	default:
+		err = printListing(os.Stdout, entries, sizes, func(i int) string {
+			if recursive {
+				return entries[i].Key
+			}
+			return strings.TrimPrefix(entries[i].Key, prefix)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// Unreadable entries are listed without sizes.
+	return skipped.err()
+}
+
+func printListing(w io.Writer, entries []*listEntry, sizes bool, name func(int) string) error {
+	if !sizes {
+		for i := range entries {
+			if _, err := fmt.Fprintln(w, name(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tCIPHERTEXT\tPLAINTEXT\tTERM")
+	for i, e := range entries {
+		if e.entryStat == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\n", name(i))
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", name(i), e.CiphertextSize, e.PlaintextSize, e.Term)
+	}
+	return tw.Flush()
+}
+
+// baseName returns the final element of key.  Subtrees retain their trailing
+// slash.
+func baseName(key string) string {
+	trimmed := strings.TrimSuffix(key, "/")
+	name := trimmed[strings.LastIndex(trimmed, "/")+1:]
+	if isSubtree(key) {
+		name += "/"
+	}
+	return name
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/helper/compressutil"
+	"github.com/hashicorp/vault/physical"
 	"github.com/hashicorp/vault/physical/file"
 	"github.com/hashicorp/vault/vault"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/saj/vault-tools/internal/journal"
+	"github.com/saj/vault-tools/internal/lock"
 	"github.com/saj/vault-tools/internal/util"
 )
 
@@ -30,19 +34,73 @@ func main() {
 		masterKeyPath = app.Flag("master-key",
 			"Local filesystem path to the Vault master key file.  The program will interactively prompt for the Vault master key if this flag is not supplied.  The Vault master key must be supplied as a base64 encoded string; vault-construct-master-key outputs the Vault master key in this format.").
 			PlaceHolder("PATH").ExistingFile()
+		force = app.Flag("force",
+			"Modify the storage backend even if a Vault server appears to be using it.  Commands that modify the backend take an advisory lock on PATH.lock, and refuse to run if a process holds core/lock open or if the backend was modified in the last few minutes by something other than these tools.").
+			Bool()
+		journalPath = app.Flag("journal",
+			"Local filesystem path to the operation journal.  Every command that modifies the backend appends a record of each change to this file.  Defaults to PATH.journal.").
+			PlaceHolder("FILE").String()
+		journalKeyPath = app.Flag("journal-key",
+			"Local filesystem path to a file containing a base64 encoded key used to authenticate journal records.  If this flag is not supplied, the journal key is derived from the Vault master key.").
+			PlaceHolder("PATH").ExistingFile()
+
+		listCmd       = app.Command("list", "List keys.")
+		listPrefix    = listCmd.Arg("prefix", "").Default("/").String()
+		listRecursive = listCmd.Flag("recursive", "Descend into subtrees.  Plain output will name each key by its full path.").Short('r').Bool()
+		listFormat    = listCmd.Flag("format", "Output format: plain, tree (indented), or json.").Default(listFormatPlain).Enum(listFormats...)
+		listSizes     = listCmd.Flag("sizes", "Show the ciphertext size, decompressed plaintext size, and keyring term of each entry.  Entries that cannot be read are reported on standard error, listed without sizes, and make the command fail once the listing is complete.").Bool()
+
+		duCmd    = app.Command("du", "Summarise storage usage by top-level prefix and by mount.  Mount storage areas (logical/<uuid>, auth/<uuid>) are resolved to their mount paths through the mount tables.  Entries that cannot be read are reported on standard error and left out of the totals, and make the command fail once the report is complete.")
+		duPrefix = duCmd.Arg("prefix", "").Default("/").String()
+		duTop    = duCmd.Flag("top", "Number of largest entries to show.  Use --top 0 to omit this report.").Default("10").Int()
 
-		listCmd    = app.Command("list", "List keys.")
-		listPrefix = listCmd.Arg("prefix", "").Default("/").String()
+		grepCmd        = app.Command("grep", "Search decrypted and decompressed data in the Vault barrier for a regular expression.  Each match is printed with its key and surrounding data.  Exits with status 1 if nothing matched.  Entries that cannot be read are reported on standard error and skipped, and make the command fail once the search is complete.")
+		grepPattern    = grepCmd.Arg("pattern", "").Required().String()
+		grepPrefix     = grepCmd.Arg("prefix", "").Default("/").String()
+		grepFixed      = grepCmd.Flag("fixed-strings", "Interpret the pattern as a literal string.").Short('F').Bool()
+		grepIgnoreCase = grepCmd.Flag("ignore-case", "Match without regard to case.").Short('i').Bool()
+		grepContext    = grepCmd.Flag("context", "Number of bytes of data to show either side of each match.").Short('C').Default("32").Int()
+		grepPaths      = grepCmd.Flag("paths", "Print only the logical path (for example, secret/foo rather than logical/<uuid>/foo) of each matching entry.").Short('l').Bool()
 
 		readCmd        = app.Command("read", "Read and decrypt data from a Vault barrier.  Data is written to standard output as a formatted hexdump.")
 		readKey        = readCmd.Arg("key", "").Required().String()
 		readDecompress = readCmd.Flag("decompress", "Attempt to decompress data prior to output.  Enabled by default; use --no-decompress to disable.").Default("true").Bool()
 		readVerbatim   = readCmd.Flag("verbatim", "Omit hexdump; write data byte-for-byte to standard output.").Bool()
 
-		writeCmd      = app.Command("write", "Encrypt and write data to a Vault barrier.  Data is read from standard input by default; use --data to read from a file.")
-		writeKey      = writeCmd.Arg("key", "").Required().String()
-		writeData     = writeCmd.Flag("data", "Do not read data from standard input.  --data foo will write the string 'foo' to the Vault barrier.  --data @foo will write the contents of the file named 'foo' to the Vault barrier.").String()
-		writeCompress = writeCmd.Flag("compress", "Compress data before writing to the Vault barrier.").Bool()
+		writeCmd         = app.Command("write", "Encrypt and write data to a Vault barrier.  Data is read from standard input by default; use --data to read from a file.")
+		writeKey         = writeCmd.Arg("key", "").Required().String()
+		writeData        = writeCmd.Flag("data", "Do not read data from standard input.  --data foo will write the string 'foo' to the Vault barrier.  --data @foo will write the contents of the file named 'foo' to the Vault barrier.").String()
+		writeCompress    = writeCmd.Flag("compress", "Compress data before writing to the Vault barrier.  Equivalent to --compression=gzip.").Bool()
+		writeCompression = writeCmd.Flag("compression", "Compression algorithm: none, lzw, gzip, or snappy.").Default(compressionTypeNone).Enum(compressionTypes...)
+		writeGzipLevel   = writeCmd.Flag("gzip-level", "gzip compression level: speed, default, or best.").Default("best").Enum(gzipLevelNames...)
+
+		recompressCmd         = app.Command("recompress", "Rewrite compressed data in a subtree of the Vault barrier with a different compression algorithm.  Uncompressed data is left alone; not every Vault subsystem expects compressed data.")
+		recompressPrefix      = recompressCmd.Arg("prefix", "").Required().String()
+		recompressCompression = recompressCmd.Flag("compression", "Compression algorithm: none, lzw, gzip, or snappy.").Required().Enum(compressionTypes...)
+		recompressGzipLevel   = recompressCmd.Flag("gzip-level", "gzip compression level: speed, default, or best.").Default("best").Enum(gzipLevelNames...)
+		recompressDryRun      = recompressCmd.Flag("dry-run", "Report the change in size without writing anything.").Bool()
+
+		applyCmd      = app.Command("apply", "Apply a manifest of put and delete operations as a single transaction.  If any operation fails, earlier operations are rolled back.\n\nThe manifest is a JSON (*.json) or YAML list of objects with the fields: op (put or delete), key, and for put operations exactly one of value, value_base64, or file, with optional compression and gzip_level.")
+		applyManifest = applyCmd.Arg("manifest", "").Required().ExistingFile()
+		applyDryRun   = applyCmd.Flag("dry-run", "Validate and encrypt the manifest without writing anything.").Bool()
+
+		editCmd = app.Command("edit", "Decrypt data into a private temporary file and open it in $VISUAL or $EDITOR.  Changes are compressed with the same algorithm as the original data, then encrypted and written back.  The write is refused if the original data was JSON and the edited data is not, or if the data was modified by another process in the meantime.")
+		editKey = editCmd.Arg("key", "").Required().String()
+
+		encryptCmd = app.Command("encrypt", "Encrypt data from standard input with the Vault barrier keyring and write the ciphertext to standard output.  Nothing is written to the storage backend.  The key is authenticated as additional data, exactly as the barrier would when writing to key; the ciphertext is only valid at that key.")
+		encryptKey = encryptCmd.Arg("key", "").Required().String()
+
+		decryptCmd = app.Command("decrypt", "Decrypt a ciphertext from standard input and write the data byte-for-byte to standard output.  Nothing is read from the storage backend other than the keyring.  The key must name the path from which the ciphertext was copied.")
+		decryptKey = decryptCmd.Arg("key", "").Required().String()
+
+		restoreCmd       = app.Command("restore", "Copy entries at logical paths, such as secret/team-a/*, from a backup filesystem backend with its own master key into this backend.  Mount storage areas are matched through each backend's mount table by mount path, so the mounts may have different UUIDs.  Entries are re-encrypted under this backend's keyring.  An asterisk matches any sequence of characters, including slashes.  KV version 2 mounts are not supported.")
+		restoreFromPath  = restoreCmd.Flag("from", "Local filesystem path to the backup Vault filesystem storage backend.").PlaceHolder("PATH").Required().ExistingDir()
+		restoreFromKey   = restoreCmd.Flag("from-master-key", "Local filesystem path to the backup's Vault master key file.  The program will interactively prompt for the key if this flag is not supplied.").PlaceHolder("PATH").ExistingFile()
+		restoreOverwrite = restoreCmd.Flag("overwrite", "Replace entries that already exist in this backend.  By default they are skipped.").Bool()
+		restoreDryRun    = restoreCmd.Flag("dry-run", "Report what would be restored without writing anything.").Bool()
+		restorePatterns  = restoreCmd.Arg("path", "").Required().Strings()
+
+		shellCmd = app.Command("shell", "Unseal the Vault barrier once, then read commands interactively.  Barrier keys may be completed with the Tab key.  Type 'help' at the prompt for a list of commands.")
 
 		deleteCmd = app.Command("delete",
 			"Delete a key from the Vault barrier.\n\n"+
@@ -50,46 +108,176 @@ func main() {
 				"  - This command is unable to recursively remove subtrees from the Vault barrier.  Any attempt to remove a subtree will no-op, successfully.\n"+
 				"  - Any attempt to remove a non-existent key will no-op, successfully.\n\n")
 		deleteKey = deleteCmd.Arg("key", "").Required().String()
+
+		infoCmd = app.Command("info", "Summarise the storage backend: seal configuration, keyring terms, and counts of mounts, tokens, leases and identity buckets.  If --master-key is not supplied, only the details that can be read without unsealing the Vault barrier are shown.")
+
+		rawCmd          = app.Command("raw", "Inspect the physical storage backend directly, without unsealing the Vault barrier.  The Vault master key is not required.")
+		rawListCmd      = rawCmd.Command("list", "List keys in the physical backend.")
+		rawListPrefix   = rawListCmd.Arg("prefix", "").Default("/").String()
+		rawListRecurse  = rawListCmd.Flag("recursive", "Descend into subtrees.").Short('r').Bool()
+		rawListPlain    = rawListCmd.Flag("plaintext", "List only the system entries that Vault stores outside of the barrier, such as core/seal-config and core/recovery-config.  Implies --recursive.").Bool()
+		rawStatCmd      = rawCmd.Command("stat", "Show the length, keyring term, barrier version byte and nonce of one or more ciphertexts.")
+		rawStatKeys     = rawStatCmd.Arg("key", "").Required().Strings()
+		rawDumpCmd      = rawCmd.Command("dump", "Write the physical value of a key as a formatted hexdump.  Ciphertexts are not decrypted; entries stored outside of the barrier are written as plaintext.")
+		rawDumpKey      = rawDumpCmd.Arg("key", "").Required().String()
+		rawDumpVerbatim = rawDumpCmd.Flag("verbatim", "Omit hexdump; write data byte-for-byte to standard output.").Bool()
+
+		journalCmd       = app.Command("journal", "Operation journal maintenance.")
+		journalVerifyCmd = journalCmd.Command("verify", "Verify the integrity of the operation journal.  The Vault master key is not required if --journal-key is supplied.")
 	)
 
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	mutating := map[string]bool{
+		writeCmd.FullCommand():      true,
+		recompressCmd.FullCommand(): true,
+		applyCmd.FullCommand():      true,
+		editCmd.FullCommand():       true,
+		restoreCmd.FullCommand():    true,
+		shellCmd.FullCommand():      true,
+		deleteCmd.FullCommand():     true,
+	}
+	if mutating[cmd] {
+		l, err := lock.Acquire(*path, *force)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		defer l.Release() // nolint: errcheck
+		app.Terminate(func(status int) {
+			l.Release() // nolint: errcheck
+			os.Exit(status)
+		})
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if *journalPath == "" {
+		*journalPath = filepath.Clean(*path) + ".journal"
+	}
+	var journalKey []byte
+	if *journalKeyPath != "" {
+		var err error
+		journalKey, err = readKeyFile(*journalKeyPath)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+	}
+
+	if cmd == journalVerifyCmd.FullCommand() && journalKey != nil {
+		if err := verifyJournal(*journalPath, journalKey); err != nil {
+			app.Fatalf("%v", err)
+		}
+		return
+	}
+
+	if strings.HasPrefix(cmd, rawCmd.FullCommand()+" ") {
+		backend, err := openBackend(*path)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+
+		switch cmd {
+		case rawListCmd.FullCommand():
+			err = rawList(ctx, backend, *rawListPrefix, *rawListRecurse, *rawListPlain)
+		case rawStatCmd.FullCommand():
+			err = rawStat(ctx, backend, *rawStatKeys)
+		case rawDumpCmd.FullCommand():
+			err = rawDump(ctx, backend, *rawDumpKey, *rawDumpVerbatim)
+		}
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		return
+	}
+
+	if cmd == infoCmd.FullCommand() && *masterKeyPath == "" {
+		backend, err := openBackend(*path)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		if err := info(ctx, backend, nil); err != nil {
+			app.Fatalf("%v", err)
+		}
+		return
+	}
+
 	var masterKey []byte
 	if *masterKeyPath != "" {
 		var err error
-		masterKey, err = readMasterKey(*masterKeyPath)
+		masterKey, err = readKeyFile(*masterKeyPath)
 		if err != nil {
 			app.Fatalf("%v", err)
 		}
 	} else {
 		var err error
-		masterKey, err = promptForMasterKey()
+		masterKey, err = promptForMasterKey("Enter master key: ")
 		if err != nil {
 			app.Fatalf("%v", err)
 		}
 	}
 
-	var barrier *vault.AESGCMBarrier
+	var (
+		backend physical.Backend
+		barrier *vault.AESGCMBarrier
+	)
 	{
 		var err error
-		barrier, err = openBarrier(*path)
+		backend, err = openBackend(*path)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		if journalKey == nil {
+			journalKey = journal.DeriveKey(masterKey)
+		}
+		// Unsealing may itself write, to upgrade a legacy keyring, so the
+		// journal is opened first.
+		var jb *journaledBackend
+		if mutating[cmd] {
+			jb = &journaledBackend{Backend: backend}
+			jb.journal, err = journal.Open(*journalPath, journalKey, progname)
+			if err != nil {
+				app.Fatalf("%v", err)
+			}
+			defer jb.journal.Close() // nolint: errcheck
+			backend = jb
+		}
+		barrier, err = vault.NewAESGCMBarrier(backend)
 		if err != nil {
 			app.Fatalf("%v", err)
 		}
 		if err := barrier.Unseal(ctx, masterKey); err != nil {
 			app.Fatalf("%v", err)
 		}
+		if jb != nil {
+			jb.barrier = barrier
+		}
 	}
 
 	switch cmd {
 	case listCmd.FullCommand():
-		if err := list(ctx, barrier, *listPrefix); err != nil {
+		if err := list(ctx, backend, barrier, *listPrefix, *listRecursive, *listFormat, *listSizes); err != nil {
 			app.Fatalf("%v", err)
 		}
 
+	case duCmd.FullCommand():
+		if err := du(ctx, backend, barrier, *duPrefix, *duTop); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case grepCmd.FullCommand():
+		re, err := compilePattern(*grepPattern, *grepFixed, *grepIgnoreCase)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		matched, err := grep(ctx, backend, barrier, re, *grepPrefix, *grepContext, *grepPaths)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		if !matched {
+			os.Exit(1)
+		}
+
 	case readCmd.FullCommand():
 		if err := read(ctx, barrier, *readKey, *readDecompress, *readVerbatim); err != nil {
 			app.Fatalf("%v", err)
@@ -107,7 +295,62 @@ func main() {
 			}
 		}
 
-		if err := write(ctx, barrier, *writeKey, value, *writeCompress); err != nil {
+		compression := *writeCompression
+		if *writeCompress && compression == compressionTypeNone {
+			compression = compressutil.CompressionTypeGzip
+		}
+		cfg := compressionConfig(compression, *writeGzipLevel)
+		if err := write(ctx, barrier, *writeKey, value, cfg); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case recompressCmd.FullCommand():
+		cfg := compressionConfig(*recompressCompression, *recompressGzipLevel)
+		if err := recompress(ctx, backend, barrier, *recompressPrefix, cfg, *recompressDryRun); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case applyCmd.FullCommand():
+		if err := apply(ctx, backend, barrier, *applyManifest, *applyDryRun); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case editCmd.FullCommand():
+		if err := edit(ctx, backend, barrier, *editKey); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case infoCmd.FullCommand():
+		if err := info(ctx, backend, barrier); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case encryptCmd.FullCommand():
+		if err := encrypt(ctx, barrier, *encryptKey); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case decryptCmd.FullCommand():
+		if err := decrypt(ctx, barrier, *decryptKey); err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case restoreCmd.FullCommand():
+		backup, err := openBackup(ctx, *restoreFromPath, *restoreFromKey)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		err = restoreFrom(ctx, backup, barrier, *restorePatterns, *restoreOverwrite, *restoreDryRun)
+		backup.Seal() // nolint: errcheck
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+
+	case shellCmd.FullCommand():
+		err := runShell(ctx, backend, barrier)
+		barrier.Seal() // nolint: errcheck
+		util.Zeroize(masterKey)
+		if err != nil {
 			app.Fatalf("%v", err)
 		}
 
@@ -115,18 +358,12 @@ func main() {
 		if err := barrier.Delete(ctx, *deleteKey); err != nil {
 			app.Fatalf("%v", err)
 		}
-	}
-}
 
-func list(ctx context.Context, barrier *vault.AESGCMBarrier, prefix string) error {
-	keys, err := barrier.List(ctx, prefix)
-	if err != nil {
-		return err
-	}
-	for i := range keys {
-		fmt.Println(keys[i])
+	case journalVerifyCmd.FullCommand():
+		if err := verifyJournal(*journalPath, journalKey); err != nil {
+			app.Fatalf("%v", err)
+		}
 	}
-	return nil
 }
 
 func read(ctx context.Context, barrier *vault.AESGCMBarrier, key string, decompress, verbatim bool) error {
@@ -139,12 +376,14 @@ func read(ctx context.Context, barrier *vault.AESGCMBarrier, key string, decompr
 	}
 
 	value := entry.Value
-	if decompress {
-		decompressed, notCompressed, cErr := compressutil.Decompress(value)
-		if cErr != nil {
-			return cErr
-		}
-		if !notCompressed {
+	cfg, decompressed, err := detectCompression(value)
+	if err != nil && decompress {
+		return err
+	}
+	// A raw value may begin with a compression canary by chance.
+	if err == nil && cfg != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s is compressed: %s\n", progname, key, describeCompression(cfg))
+		if decompress {
 			value = decompressed
 		}
 	}
@@ -165,17 +404,10 @@ func read(ctx context.Context, barrier *vault.AESGCMBarrier, key string, decompr
 	return nil
 }
 
-func write(ctx context.Context, barrier *vault.AESGCMBarrier, key string, value []byte, compress bool) error {
-	if compress {
-		cfg := &compressutil.CompressionConfig{
-			Type:                 compressutil.CompressionTypeGzip,
-			GzipCompressionLevel: gzip.BestCompression,
-		}
-		compressed, err := compressutil.Compress(value, cfg)
-		if err != nil {
-			return err
-		}
-		value = compressed
+func write(ctx context.Context, barrier *vault.AESGCMBarrier, key string, value []byte, cfg *compressutil.CompressionConfig) error {
+	value, err := compress(value, cfg)
+	if err != nil {
+		return err
 	}
 
 	return barrier.Put(ctx, &vault.Entry{
@@ -184,7 +416,41 @@ func write(ctx context.Context, barrier *vault.AESGCMBarrier, key string, value
 	})
 }
 
-func openBarrier(backendPath string) (*vault.AESGCMBarrier, error) {
+// encrypt seals standard input as the barrier would seal a value written to
+// key.
+func encrypt(ctx context.Context, barrier *vault.AESGCMBarrier, key string) error {
+	if key == keyringPath || unencryptedKeys[key] {
+		return fmt.Errorf("%s is not encrypted by the barrier keyring", key)
+	}
+
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := barrier.Encrypt(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(ciphertext)
+	return err
+}
+
+// decrypt opens a ciphertext read from standard input as though it had been
+// read from key.
+func decrypt(ctx context.Context, barrier *vault.AESGCMBarrier, key string) error {
+	ciphertext, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	value, err := decryptValue(ctx, barrier, key, ciphertext)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(value)
+	return err
+}
+
+func openBackend(backendPath string) (physical.Backend, error) {
 	logger := hclog.New(&hclog.LoggerOptions{
 		Name:  progname,
 		Level: hclog.LevelFromString("INFO"),
@@ -192,25 +458,57 @@ func openBarrier(backendPath string) (*vault.AESGCMBarrier, error) {
 
 	conf := map[string]string{"path": backendPath}
 
-	backend, err := file.NewFileBackend(conf, logger)
+	return file.NewFileBackend(conf, logger)
+}
+
+// openBackup unseals a second, read-only backend.
+func openBackup(ctx context.Context, backendPath, masterKeyPath string) (*vault.AESGCMBarrier, error) {
+	var masterKey []byte
+	var err error
+	if masterKeyPath != "" {
+		masterKey, err = readKeyFile(masterKeyPath)
+	} else {
+		masterKey, err = promptForMasterKey("Enter backup master key: ")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer util.Zeroize(masterKey)
+
+	backend, err := openBackend(backendPath)
 	if err != nil {
 		return nil, err
 	}
+	barrier, err := vault.NewAESGCMBarrier(backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := barrier.Unseal(ctx, masterKey); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	return barrier, nil
+}
 
-	return vault.NewAESGCMBarrier(backend)
+func verifyJournal(path string, key []byte) error {
+	n, err := journal.Verify(path, key)
+	if err != nil {
+		return fmt.Errorf("%s: %d records verified before failure: %v", path, n, err)
+	}
+	fmt.Printf("%s: %d records verified\n", path, n)
+	return nil
 }
 
-func promptForMasterKey() ([]byte, error) {
+func promptForMasterKey(prompt string) ([]byte, error) {
 	t, err := util.NewTerminal()
 	if err != nil {
 		return nil, err
 	}
 	defer t.Restore() // nolint: errcheck
 
-	return t.ReadKeyBase64("Enter master key: ")
+	return t.ReadKeyBase64(prompt)
 }
 
-func readMasterKey(path string) ([]byte, error) {
+func readKeyFile(path string) ([]byte, error) {
 	key, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/layout"
+)
+
+// rawHeader describes the framing of a physical entry.  Nothing in it
+// requires the master key.
+type rawHeader struct {
+	Length int
+	// EncryptedWith is one of keyring, master key or none.
+	EncryptedWith string
+	*layout.Header
+}
+
+func parseRawHeader(key string, value []byte) (*rawHeader, error) {
+	h := &rawHeader{Length: len(value)}
+	switch {
+	case unencryptedKeys[key]:
+		h.EncryptedWith = "none"
+		return h, nil
+	case key == keyringPath:
+		h.EncryptedWith = "master key"
+	default:
+		h.EncryptedWith = "keyring"
+	}
+
+	header, err := layout.ParseHeader(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	h.Header = header
+	return h, nil
+}
+
+// rawList lists keys in the physical backend.  If plaintext is set, only
+// entries that Vault stores outside of the barrier are listed.
+func rawList(ctx context.Context, backend physical.Backend, prefix string, recursive, plaintext bool) error {
+	prefix = normalisePrefix(prefix)
+	return walk(ctx, backend, prefix, recursive || plaintext, func(key string, depth int) error {
+		if plaintext && !unencryptedKeys[key] {
+			return nil
+		}
+		if recursive && isSubtree(key) {
+			return nil
+		}
+		if recursive || plaintext {
+			fmt.Println(key)
+		} else {
+			fmt.Println(key[len(prefix):])
+		}
+		return nil
+	})
+}
+
+// rawStat prints the ciphertext framing of each key: its length, keyring
+// term, barrier version byte and nonce.
+func rawStat(ctx context.Context, backend physical.Backend, keys []string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tLENGTH\tENCRYPTED WITH\tTERM\tVERSION\tNONCE")
+	for _, key := range keys {
+		pe, err := backend.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if pe == nil {
+			return fmt.Errorf("no value at %s", key)
+		}
+		h, err := parseRawHeader(key, pe.Value)
+		if err != nil {
+			return err
+		}
+		if h.EncryptedWith == "none" {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t-\t-\t-\n", key, h.Length, h.EncryptedWith)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\t%s\n", key, h.Length, h.EncryptedWith, h.Term, describeVersion(h.Version), hex.EncodeToString(h.Nonce))
+	}
+	return tw.Flush()
+}
+
+func describeVersion(v byte) string {
+	switch v {
+	case vault.AESGCMVersion1:
+		return "1"
+	case vault.AESGCMVersion2:
+		return "2 (path as AAD)"
+	default:
+		return fmt.Sprintf("unknown (%#x)", v)
+	}
+}
+
+// rawDump writes the physical value at key without decrypting it.  For the
+// entries Vault stores outside of the barrier, this is the plaintext.
+func rawDump(ctx context.Context, backend physical.Backend, key string, verbatim bool) error {
+	pe, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if pe == nil {
+		return fmt.Errorf("no value at %s", key)
+	}
+
+	if verbatim {
+		_, err := os.Stdout.Write(pe.Value)
+		return err
+	}
+	d := hex.Dumper(os.Stdout)
+	if _, err := d.Write(pe.Value); err != nil {
+		return err
+	}
+	return d.Close()
+}
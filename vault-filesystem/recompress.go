@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/vault/helper/compressutil"
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+)
+
+// recompress rewrites every compressed value below prefix with cfg.  A nil
+// cfg stores values uncompressed.  Values that were not compressed to begin
+// with are left untouched: Vault only expects compressed data where it wrote
+// compressed data.
+func recompress(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, prefix string, cfg *compressutil.CompressionConfig, dryRun bool) error {
+	var (
+		rewritten     int
+		before, after int64
+	)
+
+	err := walk(ctx, barrier, prefix, true, func(key string, depth int) error {
+		if isSubtree(key) || key == keyringPath || unencryptedKeys[key] {
+			return nil
+		}
+
+		entry, err := barrier.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return nil
+		}
+
+		found, plaintext, err := detectCompression(entry.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if found == nil || sameCompression(found, cfg) {
+			return nil
+		}
+
+		value, err := compress(plaintext, cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		rewritten++
+		before += int64(len(entry.Value))
+		after += int64(len(value))
+
+		if dryRun {
+			return nil
+		}
+		return barrier.Put(ctx, &vault.Entry{
+			Key:      key,
+			Value:    value,
+			SealWrap: entry.SealWrap,
+		})
+	})
+
+	verb := "recompressed"
+	if dryRun {
+		verb = "would recompress"
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s %d entries; compressed size %d -> %d bytes\n", progname, verb, rewritten, before, after)
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/vault/vault"
+	glob "github.com/ryanuber/go-glob"
+
+	"github.com/saj/vault-tools/internal/mounttable"
+)
+
+// restoreFrom copies the entries at logical paths matching patterns from a
+// backup barrier into the target barrier.  Each mount's storage area is
+// found through each side's own mount table, so mounts need not share a
+// UUID.  Entries are decrypted under the backup keyring and re-encrypted
+// under the target keyring.
+//
+// An asterisk in a pattern matches any sequence of characters, including
+// slashes.  Entries that already exist in the target are skipped unless
+// overwrite is set.  KV version 2 mounts are refused.
+func restoreFrom(ctx context.Context, backup, target *vault.AESGCMBarrier, patterns []string, overwrite, dryRun bool) error {
+	backupMounts, err := mounttable.Load(ctx, backup)
+	if err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	targetMounts, err := mounttable.Load(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	var restored, skipped int
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "/")
+		literal := pattern
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			literal = pattern[:i]
+		}
+
+		src, rest := backupMounts.Route(literal)
+		if src == nil {
+			return fmt.Errorf("%s: no such mount in backup", pattern)
+		}
+		dst := targetMounts.ByPath(src.Path)
+		if dst == nil {
+			return fmt.Errorf("%s: %s is not mounted in target", pattern, src.Path)
+		}
+		if dst.Type != src.Type {
+			return fmt.Errorf("%s: %s is a %s mount in backup but a %s mount in target", pattern, src.Path, src.Type, dst.Type)
+		}
+		// Logical paths are matched against barrier keys directly, which
+		// only holds for mounts that store each path under its own key.
+		if src.IsKVv2() || dst.IsKVv2() {
+			return fmt.Errorf("%s: %s is a KV version 2 mount; restore does not support its versioned storage layout", pattern, src.Path)
+		}
+
+		prefix := src.BarrierPrefix
+		if i := strings.LastIndex(rest, "/"); i >= 0 {
+			prefix += rest[:i+1]
+		}
+
+		var matched int
+		err := walk(ctx, backup, prefix, true, func(key string, depth int) error {
+			if isSubtree(key) {
+				return nil
+			}
+			mountRest := strings.TrimPrefix(key, src.BarrierPrefix)
+			logical := src.Path + mountRest
+			if !glob.Glob(pattern, logical) {
+				return nil
+			}
+			matched++
+
+			targetKey := dst.BarrierPrefix + mountRest
+			existing, err := target.Get(ctx, targetKey)
+			if err != nil {
+				return err
+			}
+			if existing != nil && !overwrite {
+				fmt.Fprintf(os.Stderr, "%s: skip %s: exists in target\n", progname, logical)
+				skipped++
+				return nil
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: restore %s\n", progname, logical)
+			restored++
+			if dryRun {
+				return nil
+			}
+			entry, err := backup.Get(ctx, key)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				return fmt.Errorf("%s: removed from backup during restore", key)
+			}
+			entry.Key = targetKey
+			return target.Put(ctx, entry)
+		})
+		if err != nil {
+			return err
+		}
+		if matched == 0 {
+			fmt.Fprintf(os.Stderr, "%s: %s: nothing in backup matches\n", progname, pattern)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %d restored, %d skipped\n", progname, restored, skipped)
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/mounttable"
+	"github.com/saj/vault-tools/internal/util"
+)
+
+const shellHelp = `Commands:
+  cd [dir]           Change the working subtree.
+  ls [dir]           List keys.
+  cat <key>          Write decrypted, decompressed data verbatim.
+  hexdump <key>      Write decrypted, decompressed data as a hexdump.
+  put <key> <data>   Encrypt and write data.  @file writes the contents of file.
+  rm <key>           Delete a key.
+  mounts             List the secret and credential mount tables.
+  help               Show this message.
+  exit               Leave the shell.  Ctrl-D also works.
+`
+
+var shellCommands = []string{"cat", "cd", "exit", "help", "hexdump", "ls", "mounts", "put", "rm"}
+
+type shell struct {
+	ctx     context.Context
+	backend physical.Backend
+	barrier *vault.AESGCMBarrier
+	term    *util.Terminal
+	// cwd is the working subtree.  It is empty at the root, and otherwise
+	// carries a trailing slash.
+	cwd string
+}
+
+// runShell runs an interactive read-eval-print loop against an unsealed
+// barrier until the user exits.
+func runShell(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier) error {
+	t, err := util.NewTerminal()
+	if err != nil {
+		return err
+	}
+	defer t.Restore() // nolint: errcheck
+
+	sh := &shell{
+		ctx:     ctx,
+		backend: backend,
+		barrier: barrier,
+		term:    t,
+	}
+	t.SetAutoCompleteCallback(sh.complete)
+
+	for {
+		line, err := t.ReadLine(fmt.Sprintf("%s:/%s> ", progname, sh.cwd))
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		args := splitFields(line, 0)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := sh.exec(line, args); err != nil {
+			fmt.Fprintf(t, "%s: %v\n", args[0], err)
+		}
+	}
+}
+
+func (sh *shell) exec(line string, args []string) error {
+	switch args[0] {
+	case "help":
+		_, err := io.WriteString(sh.term, shellHelp)
+		return err
+
+	case "cd":
+		dir := ""
+		if len(args) > 1 {
+			dir = normalisePrefix(sh.resolve(args[1]))
+		}
+		if dir != "" {
+			keys, err := sh.barrier.List(sh.ctx, dir)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return fmt.Errorf("no such subtree: %s", dir)
+			}
+		}
+		sh.cwd = dir
+		return nil
+
+	case "ls":
+		dir := sh.cwd
+		if len(args) > 1 {
+			dir = sh.resolve(args[1])
+		}
+		return walk(sh.ctx, sh.barrier, dir, false, func(key string, depth int) error {
+			_, err := fmt.Fprintln(sh.term, baseName(key))
+			return err
+		})
+
+	case "cat", "hexdump":
+		if len(args) != 2 {
+			return errors.New("expected one key")
+		}
+		key := sh.resolve(args[1])
+		_, plaintext, err := getPlaintext(sh.ctx, sh.backend, sh.barrier, key)
+		if err != nil {
+			return err
+		}
+		if plaintext == nil {
+			return fmt.Errorf("no value at %s", key)
+		}
+
+		if args[0] == "hexdump" {
+			d := hex.Dumper(sh.term)
+			if _, err := d.Write(plaintext); err != nil {
+				return err
+			}
+			return d.Close()
+		}
+		if _, err := sh.term.Write(plaintext); err != nil {
+			return err
+		}
+		if len(plaintext) > 0 && plaintext[len(plaintext)-1] != '\n' {
+			_, err = io.WriteString(sh.term, "\n")
+		}
+		return err
+
+	case "put":
+		args = splitFields(line, 3)
+		if len(args) != 3 {
+			return errors.New("expected a key and data")
+		}
+		value := []byte(args[2])
+		if strings.HasPrefix(args[2], "@") {
+			var err error
+			value, err = ioutil.ReadFile(args[2][1:])
+			if err != nil {
+				return err
+			}
+		}
+		return write(sh.ctx, sh.barrier, sh.resolve(args[1]), value, nil)
+
+	case "rm":
+		if len(args) < 2 {
+			return errors.New("expected at least one key")
+		}
+		for _, arg := range args[1:] {
+			if err := sh.barrier.Delete(sh.ctx, sh.resolve(arg)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "mounts":
+		mounts, err := mounttable.Load(sh.ctx, sh.barrier)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(sh.term, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PATH\tTYPE\tSTORAGE\tLOCAL")
+		for _, m := range mounts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", m.Path, m.Type, m.BarrierPrefix, m.Local)
+		}
+		return tw.Flush()
+
+	default:
+		return errors.New("unknown command; try help")
+	}
+}
+
+// resolve interprets arg relative to the working subtree.  Absolute
+// arguments begin with a slash.  The result is a barrier key; a trailing
+// slash on arg is preserved.
+func (sh *shell) resolve(arg string) string {
+	p := arg
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + sh.cwd + p
+	}
+	key := strings.TrimPrefix(path.Clean(p), "/")
+	if key != "" && isSubtree(arg) {
+		key += "/"
+	}
+	return key
+}
+
+// complete implements tab completion of command names and barrier keys.
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := line[start:pos]
+
+	var dir, base string
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		base = word
+		candidates = shellCommands
+	} else {
+		if i := strings.LastIndex(word, "/"); i >= 0 {
+			dir, base = word[:i+1], word[i+1:]
+		} else {
+			base = word
+		}
+
+		prefix := sh.cwd
+		if dir != "" {
+			prefix = normalisePrefix(sh.resolve(dir))
+		}
+		keys, err := sh.barrier.List(sh.ctx, prefix)
+		if err != nil {
+			return "", 0, false
+		}
+		candidates = keys
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, base) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+
+	completion := dir + commonPrefix(matches)
+	if len(matches) == 1 && !isSubtree(completion) {
+		completion += " "
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+func commonPrefix(s []string) string {
+	p := s[0]
+	for _, t := range s[1:] {
+		for !strings.HasPrefix(t, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
+
+// splitFields splits line around runs of white space.  If n is greater than
+// zero, at most n fields are returned; the last field holds the unsplit
+// remainder of line.
+func splitFields(line string, n int) []string {
+	var fields []string
+	line = strings.TrimLeft(line, " \t")
+	for line != "" {
+		if n > 0 && len(fields) == n-1 {
+			fields = append(fields, line)
+			break
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			fields = append(fields, line)
+			break
+		}
+		fields = append(fields, line[:i])
+		line = strings.TrimLeft(line[i:], " \t")
+	}
+	return fields
+}
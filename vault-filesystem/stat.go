@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/physical"
+	"github.com/hashicorp/vault/vault"
+
+	"github.com/saj/vault-tools/internal/layout"
+)
+
+type entryStat struct {
+	CiphertextSize int    `json:"ciphertext_size"`
+	PlaintextSize  int    `json:"plaintext_size"`
+	Term           uint32 `json:"term"`
+}
+
+// statEntry reports the on-disk and decompressed plaintext sizes of the
+// value at key, along with the keyring term under which it was encrypted.
+// Entries stored outside of the barrier report a term of zero.
+func statEntry(ctx context.Context, backend physical.Backend, barrier *vault.AESGCMBarrier, key string) (*entryStat, error) {
+	ciphertext, plaintext, err := getPlaintext(ctx, backend, barrier, key)
+	if err != nil {
+		return nil, err
+	}
+	if ciphertext == nil {
+		return nil, fmt.Errorf("no value at %s", key)
+	}
+
+	var term uint32
+	if !unencryptedKeys[key] {
+		h, err := layout.ParseHeader(ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		term = h.Term
+	}
+
+	return &entryStat{
+		CiphertextSize: len(ciphertext),
+		PlaintextSize:  len(plaintext),
+		Term:           term,
+	}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// lister is satisfied by both the physical backend and the barrier.
+type lister interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// walkFunc is called once for each key visited by walk.  Keys that name a
+// subtree carry a trailing slash.  depth is zero for keys immediately below
+// the walk root.
+type walkFunc func(key string, depth int) error
+
+// walk visits every key below prefix in lexical order.  Subtrees are visited
+// before their contents.  If recursive is false, walk does not descend into
+// subtrees.
+func walk(ctx context.Context, l lister, prefix string, recursive bool, fn walkFunc) error {
+	return walkDepth(ctx, l, normalisePrefix(prefix), recursive, 0, fn)
+}
+
+func walkDepth(ctx context.Context, l lister, prefix string, recursive bool, depth int, fn walkFunc) error {
+	keys, err := l.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := prefix + k
+
+		if err := fn(p, depth); err != nil {
+			return err
+		}
+
+		if recursive && isSubtree(k) {
+			if err := walkDepth(ctx, l, p, recursive, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unreadable counts the entries that a walk could not read.  Reports and
+// searches carry on past such entries, so that one bad entry does not hide
+// every entry after it.
+type unreadable int
+
+// skip reports err on standard error and counts the entry.  If the walk was
+// cancelled, the cancellation is returned instead, to stop it.
+func (u *unreadable) skip(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", progname, err)
+	*u++
+	return nil
+}
+
+// err returns an error if any entry was skipped.
+func (u unreadable) err() error {
+	if u == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d entries could not be read", int(u))
+}
+
+// normalisePrefix converts a user-supplied key prefix into the form used by
+// Vault: no leading slash, and a trailing slash on anything but the root.
+//
+// The barrier uses each key as additional authenticated data.  A stray
+// leading slash would successfully locate an entry on disk but fail
+// decryption.
+func normalisePrefix(prefix string) string {
+	prefix = strings.TrimLeft(prefix, "/")
+	if prefix != "" && !isSubtree(prefix) {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func isSubtree(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	hclog "github.com/hashicorp/go-hclog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/lock"
+	"github.com/saj/vault-tools/internal/stage"
+	"github.com/saj/vault-tools/internal/util"
+)
+
+const progname = "vault-migrate"
+
+func main() {
+	app := kingpin.New(progname,
+		"Copy Vault data from one storage backend or format to another.  Entries are copied verbatim, still encrypted; the Vault master key is not required.\n\n"+
+			"Backends are named as scheme:address.  The schemes are:\n\n"+
+			"    file:PATH            a Vault filesystem storage backend\n"+
+			"    consul:ADDR          the KV store of a live Consul agent, such as 127.0.0.1:8500 or https://consul.example:8501\n"+
+			"    consul-export:FILE   a JSON-serialised Consul KV tree ('consul kv export')\n"+
+			"    consul-txn:DIR       a directory of Consul transaction API payloads, each of up to 64 keys\n"+
+			"    jsonl:FILE           one JSON object per line, with key and base64 value fields; - is standard input or output\n"+
+			"    inmem:NAME           a Vault in-memory backend, for testing\n\n"+
+			"A local destination is written to DEST.staging, and moved into place only once the copy is complete.\n\n"+
+			"Example:\n\n"+
+			"    consul kv export vault >vault.json\n"+
+			"    vault-migrate --from consul-export:vault.json --to file:backend\n"+
+			"    vault-migrate --from file:backend --to consul:127.0.0.1:8500\n").
+		UsageTemplate(kingpin.CompactUsageTemplate)
+	from := app.Flag("from",
+		"Source backend.").
+		PlaceHolder("SCHEME:ADDR").Required().String()
+	to := app.Flag("to",
+		"Destination backend.").
+		PlaceHolder("SCHEME:ADDR").Required().String()
+	opts := &backend.Options{}
+	app.Flag("consul-path",
+		"Consul key prefix for Vault data.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").
+		Default("vault").StringVar(&opts.ConsulPath)
+	backend.ConsulFlags(app, opts)
+	backend.ConsulLimitFlags(app, opts)
+	filter := &backend.Filter{}
+	backend.FilterFlags(app, filter)
+	app.Flag("parallel",
+		"Maximum number of concurrent operations against a file: or inmem: source backend.").
+		Default(strconv.Itoa(backend.DefaultParallel)).IntVar(&opts.Parallel)
+	force := app.Flag("force",
+		"Replace a destination that is not empty, and use a filesystem backend even if a Vault server appears to be using it.  Without --force, the program refuses to run if the destination holds any entries.  The program takes an advisory lock on PATH.lock for each filesystem backend, and refuses to run if a process holds core/lock open or if the backend was modified in the last few minutes by something other than these tools.").
+		Bool()
+
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	ctx, stop := util.CancelOnInterrupt(context.Background())
+	defer stop()
+
+	if sameSpec(*from, *to) {
+		app.Fatalf("source and destination are the same: %s", *from)
+	}
+
+	var locks []*lock.Lock
+	release := func() {
+		for _, l := range locks {
+			l.Release() // nolint: errcheck
+		}
+		locks = nil
+	}
+	app.Terminate(func(status int) {
+		release()
+		os.Exit(status)
+	})
+	for _, spec := range []string{*from, *to} {
+		scheme, addr, err := backend.ParseSpec(spec)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		if scheme != backend.SchemeFile {
+			continue
+		}
+		l, err := lock.Acquire(addr, *force)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		locks = append(locks, l)
+	}
+
+	opts.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:  progname,
+		Level: hclog.LevelFromString("INFO"),
+	})
+	if !*force {
+		if err := checkEmpty(ctx, *to, opts); err != nil {
+			app.Fatalf("%v", err)
+		}
+	}
+
+	// Local output is staged, and committed once complete.
+	stagedSpec := *to
+	output := localOutput(*to)
+	if output != nil {
+		if err := output.Prepare(false); err != nil {
+			app.Fatalf("%v", err)
+		}
+		scheme, _, _ := backend.ParseSpec(*to)
+		stagedSpec = scheme + ":" + output.Path()
+	}
+	n, err := migrate(ctx, *from, stagedSpec, filter, opts)
+	if err == nil && output != nil {
+		_, err = output.Commit()
+	}
+	release()
+	if ctx.Err() != nil {
+		if output != nil {
+			app.Fatalf("interrupted; %s is unchanged", *to)
+		}
+		app.Fatalf("interrupted")
+	}
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: copied %d entries from %s to %s\n", progname, n, *from, *to)
+}
+
+func migrate(ctx context.Context, from, to string, filter *backend.Filter, opts *backend.Options) (n int, err error) {
+	src, err := backend.OpenSource(ctx, from, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeError := src.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+
+	dst, err := backend.OpenSink(ctx, to, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeError := dst.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+
+	return backend.Copy(ctx, dst, backend.FilterSource(src, filter))
+}
+
+// localOutput returns the stage for a destination in the local filesystem,
+// or nil if the destination is standard output, Consul or in memory.
+func localOutput(spec string) *stage.Stage {
+	scheme, addr, err := backend.ParseSpec(spec)
+	if err != nil {
+		return nil
+	}
+	switch scheme {
+	case backend.SchemeFile, backend.SchemeConsulExport, backend.SchemeConsulTxn:
+		return stage.New(addr)
+	case backend.SchemeJSONL:
+		if addr == "-" {
+			return nil
+		}
+		return stage.New(addr)
+	}
+	return nil
+}
+
+// checkEmpty returns an error if the destination named by spec holds any
+// entries.
+func checkEmpty(ctx context.Context, spec string, opts *backend.Options) (err error) {
+	scheme, addr, err := backend.ParseSpec(spec)
+	if err != nil {
+		return err
+	}
+	switch scheme {
+	case backend.SchemeFile, backend.SchemeConsulExport, backend.SchemeConsulTxn, backend.SchemeJSONL:
+		if addr == "-" {
+			return nil
+		}
+		paths := []string{addr}
+		if scheme == backend.SchemeConsulExport {
+			paths = append(paths, backend.SplitPath(addr, 1))
+		}
+		for _, p := range paths {
+			empty, err := stage.IsEmpty(p)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return fmt.Errorf("%s is not empty; use --force to replace it", p)
+			}
+		}
+		return nil
+	}
+
+	dst, err := backend.OpenSource(ctx, spec, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeError := dst.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+	_, err = dst.ReadEntry(ctx)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s is not empty; use --force to replace it", spec)
+}
+
+func sameSpec(a, b string) bool {
+	as, aa, err := backend.ParseSpec(a)
+	if err != nil {
+		return false
+	}
+	bs, ba, err := backend.ParseSpec(b)
+	if err != nil {
+		return false
+	}
+	return as == bs && filepath.Clean(aa) == filepath.Clean(ba)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Archive members.  Each physical entry is stored, still encrypted, beneath
+// entriesDir.  The manifest follows the last entry.
+const (
+	entriesDir   = "entries/"
+	manifestName = "MANIFEST.json"
+)
+
+type archiveWriter struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest *manifest
+	// base holds the hashes of a base manifest when writing a delta.
+	base     map[string]string
+	archived int
+}
+
+// newArchiveWriter writes a full archive to w, or a delta archive if base is
+// not nil.
+func newArchiveWriter(w io.Writer, compress bool, m, base *manifest) *archiveWriter {
+	aw := &archiveWriter{manifest: m}
+	if base != nil {
+		aw.base = base.sums()
+	}
+	if compress {
+		aw.gz = gzip.NewWriter(w)
+		w = aw.gz
+	}
+	aw.tw = tar.NewWriter(w)
+	return aw
+}
+
+// Add records an entry in the manifest.  The entry itself is archived
+// unless it is unchanged since the base.
+func (aw *archiveWriter) Add(key string, value []byte) error {
+	sum := hashValue(value)
+	aw.manifest.add(key, sum, value)
+	if sum == aw.base[key] {
+		return nil
+	}
+	aw.archived++
+	return aw.writeMember(entriesDir+key, value)
+}
+
+// Close lists the entries deleted since the base, writes the manifest and
+// flushes the archive.  The underlying writer is not closed.
+func (aw *archiveWriter) Close() error {
+	if aw.base != nil {
+		present := aw.manifest.sums()
+		for key := range aw.base {
+			if _, ok := present[key]; !ok {
+				aw.manifest.Deleted = append(aw.manifest.Deleted, key)
+			}
+		}
+		sort.Strings(aw.manifest.Deleted)
+	}
+
+	buf, err := encodeManifest(aw.manifest)
+	if err != nil {
+		return err
+	}
+	if err := aw.writeMember(manifestName, buf); err != nil {
+		return err
+	}
+	if err := aw.tw.Close(); err != nil {
+		return err
+	}
+	if aw.gz != nil {
+		return aw.gz.Close()
+	}
+	return nil
+}
+
+func (aw *archiveWriter) writeMember(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: aw.manifest.Created,
+	}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := aw.tw.Write(data)
+	return err
+}
+
+// readArchive calls fn for each entry in a tar archive, which may be
+// gzip-compressed.  The manifest is returned, but is not checked against the
+// entries; see verifyArchive.
+func readArchive(r io.Reader, fn func(key string, value []byte) error) (*manifest, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close() // nolint: errcheck
+		r = gz
+	} else {
+		r = br
+	}
+
+	var m *manifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Archives repacked with other tools may carry directories.
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if m != nil {
+			return nil, fmt.Errorf("%s: unexpected member after manifest", hdr.Name)
+		}
+
+		switch {
+		case hdr.Name == manifestName:
+			m = &manifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("%s: %v", manifestName, err)
+			}
+
+		case strings.HasPrefix(hdr.Name, entriesDir):
+			key := strings.TrimPrefix(hdr.Name, entriesDir)
+			if err := validateKey(key); err != nil {
+				return nil, err
+			}
+			value, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if err := fn(key, value); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("%s: unexpected archive member", hdr.Name)
+		}
+	}
+
+	if m == nil {
+		return nil, errors.New("archive has no manifest; it may be truncated")
+	}
+	return m, nil
+}
+
+// verifyArchive reads the whole of an archive and checks every entry
+// against the manifest.  The hashes of the archived entries are returned
+// alongside the manifest.
+func verifyArchive(r io.Reader) (*manifest, map[string]string, error) {
+	found := make(map[string]string)
+	m, err := readArchive(r, func(key string, value []byte) error {
+		if _, ok := found[key]; ok {
+			return fmt.Errorf("%s: archived twice", key)
+		}
+		found[key] = hashValue(value)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.check(found); err != nil {
+		return nil, nil, err
+	}
+	return m, found, nil
+}
+
+// validateKey refuses keys that could escape the root of a filesystem
+// backend.
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key {
+		return fmt.Errorf("invalid key in archive: %q", key)
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == ".." {
+			return fmt.Errorf("invalid key in archive: %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/physical"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/lock"
+	"github.com/saj/vault-tools/internal/util"
+)
+
+const progname = "vault-snapshot"
+
+// version is recorded in each manifest.  Release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+func main() {
+	var (
+		app = kingpin.New(progname,
+			"Pack the still-encrypted physical entries of a Vault storage backend into a single archive, and restore them.\n\n"+
+				"An archive is a tar stream, optionally gzip-compressed.  Its final member is a manifest that records every key, the SHA-256 of each entry, the set of keyring terms under which entries were encrypted, and the version of this program.  The Vault master key is not required.").
+			UsageTemplate(kingpin.CompactUsageTemplate)
+		force = app.Flag("force",
+			"Use a filesystem backend even if a Vault server appears to be using it.  The program takes an advisory lock on PATH.lock, and refuses to run if a process holds core/lock open or if the backend was modified in the last few minutes by something other than these tools.").
+			Bool()
+
+		createCmd         = app.Command("create", "Create a snapshot archive.  The source must be quiesced: either a filesystem backend that no Vault server is using, or a JSON-serialised Consul KV export.")
+		createBackend     = createCmd.Flag("backend", "Local filesystem path to a Vault filesystem storage backend.").Short('p').PlaceHolder("PATH").ExistingDir()
+		createExport      = createCmd.Flag("consul-export", "Local filesystem path to a JSON-serialised Consul KV export, as output by 'consul kv export'.").PlaceHolder("FILE").ExistingFile()
+		createConsulPath  = createCmd.Flag("consul-path", "Consul key prefix for Vault data.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").Default("vault").String()
+		createCompression = createCmd.Flag("compression", "Archive compression: gzip or none.").Default(compressionGzip).Enum(compressionGzip, compressionNone)
+		createBase        = createCmd.Flag("base", "Write a delta archive that holds only the entries added or changed since a previous snapshot, along with a list of deleted keys.  FILE is either the previous archive or a manifest saved with --save-manifest.").PlaceHolder("FILE").ExistingFile()
+		createSave        = createCmd.Flag("save-manifest", "Also write the manifest to FILE, for use with --base.  Reading the manifest from the end of a large archive is slow.").PlaceHolder("FILE").String()
+		createOutput      = createCmd.Arg("archive", "Local filesystem path to the output archive.  The archive is written under a temporary name and renamed into place once complete.  Defaults to standard output.").Default("-").String()
+
+		restoreCmd      = app.Command("restore", "Verify a full snapshot archive and any number of delta archives against their manifests, then write the entries into an empty filesystem backend.  Deltas are applied in the order given; each must be based on the archive before it.  Nothing is written if verification fails.")
+		restoreBackend  = restoreCmd.Flag("backend", "Local filesystem path to the Vault filesystem storage backend.  The directory must be empty or not exist.").Short('p').PlaceHolder("PATH").Required().String()
+		restoreArchives = restoreCmd.Arg("archive", "").Required().ExistingFiles()
+
+		verifyCmd      = app.Command("verify", "Verify one or more snapshot archives against their manifests.  If more than one archive is given, each must be a delta based on the archive before it.")
+		verifyArchives = verifyCmd.Arg("archive", "").Required().ExistingFiles()
+	)
+
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	ctx, stop := util.CancelOnInterrupt(context.Background())
+	defer stop()
+
+	var err error
+	switch cmd {
+	case createCmd.FullCommand():
+		err = create(ctx, *createBackend, *createExport, *createConsulPath, *createCompression == compressionGzip, *createBase, *createSave, *createOutput, *force)
+
+	case restoreCmd.FullCommand():
+		err = restore(ctx, *restoreArchives, *restoreBackend, *force)
+
+	case verifyCmd.FullCommand():
+		err = verify(*verifyArchives)
+	}
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
+}
+
+func create(ctx context.Context, backendPath, exportPath, consulPath string, compress bool, basePath, savePath, outputPath string, force bool) (err error) {
+	var spec string
+	switch {
+	case backendPath != "" && exportPath != "":
+		return errors.New("--backend and --consul-export are mutually exclusive")
+
+	case backendPath != "":
+		l, lockError := lock.Acquire(backendPath, force)
+		if lockError != nil {
+			return lockError
+		}
+		defer func() {
+			if releaseError := l.Release(); releaseError != nil && err == nil {
+				err = releaseError
+			}
+		}()
+		spec = backend.SchemeFile + ":" + backendPath
+
+	case exportPath != "":
+		spec = backend.SchemeConsulExport + ":" + exportPath
+
+	default:
+		return errors.New("one of --backend or --consul-export is required")
+	}
+
+	var base *manifest
+	if basePath != "" {
+		if base, err = readManifestFile(basePath); err != nil {
+			return err
+		}
+	}
+	m, err := newManifest(spec, base)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if outputPath != "-" {
+		f, openError := os.OpenFile(outputPath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if openError != nil {
+			return openError
+		}
+		defer func() {
+			if err == nil {
+				err = f.Sync()
+			}
+			if closeError := f.Close(); closeError != nil && err == nil {
+				err = closeError
+			}
+			if err == nil {
+				err = os.Rename(f.Name(), outputPath)
+			}
+			if err != nil {
+				os.Remove(f.Name()) // nolint: errcheck
+				return
+			}
+			err = syncDir(filepath.Dir(outputPath))
+		}()
+		w = f
+	}
+
+	aw := newArchiveWriter(w, compress, m, base)
+	src, err := backend.OpenSource(ctx, spec, &backend.Options{ConsulPath: consulPath})
+	if err != nil {
+		return err
+	}
+	defer src.Close() // nolint: errcheck
+	for {
+		entry, err := src.ReadEntry(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := aw.Add(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	if savePath != "" {
+		if err := saveManifest(m, savePath); err != nil {
+			return err
+		}
+	}
+
+	if base != nil {
+		fmt.Fprintf(os.Stderr, "%s: archived %d of %d entries from %s, %d deleted since base; keyring terms: %s\n", progname, aw.archived, len(m.Entries), spec, len(m.Deleted), formatTerms(m.Terms))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: archived %d entries from %s; keyring terms: %s\n", progname, len(m.Entries), spec, formatTerms(m.Terms))
+	}
+	return nil
+}
+
+func restore(ctx context.Context, archivePaths []string, backendPath string, force bool) (err error) {
+	l, err := lock.Acquire(backendPath, force)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseError := l.Release(); releaseError != nil && err == nil {
+			err = releaseError
+		}
+	}()
+
+	if err := checkEmpty(backendPath); err != nil {
+		return err
+	}
+
+	chain, err := verifyChain(archivePaths)
+	if err != nil {
+		return err
+	}
+	if chain[0].manifest.isDelta() {
+		return fmt.Errorf("%s: is a delta; restore requires a full snapshot first", archivePaths[0])
+	}
+
+	fb, err := backend.NewFileBackend(backendPath, hclog.New(&hclog.LoggerOptions{
+		Name:  progname,
+		Level: hclog.LevelFromString("INFO"),
+	}))
+	if err != nil {
+		return err
+	}
+
+	var written, deleted int
+	for _, a := range chain {
+		f, err := os.Open(a.path)
+		if err != nil {
+			return err
+		}
+
+		// The archive is read a second time.  Check each entry again in
+		// case the file changed after verification.
+		_, err = readArchive(f, func(key string, value []byte) error {
+			if hashValue(value) != a.archived[key] {
+				return fmt.Errorf("%s: %s: checksum mismatch; archive changed during restore; %s is incomplete", a.path, key, backendPath)
+			}
+			if err := fb.Put(ctx, &physical.Entry{Key: key, Value: value}); err != nil {
+				return err
+			}
+			written++
+			return nil
+		})
+		f.Close() // nolint: errcheck
+		if err != nil {
+			return err
+		}
+
+		for _, key := range a.manifest.Deleted {
+			if err := fb.Delete(ctx, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+
+	last := chain[len(chain)-1].manifest
+	fmt.Fprintf(os.Stderr, "%s: restored %d entries to %s from %d archives (%d writes, %d deletes); keyring terms: %s\n", progname, len(last.Entries), backendPath, len(chain), written, deleted, formatTerms(last.Terms))
+	return nil
+}
+
+func verify(archivePaths []string) error {
+	chain, err := verifyChain(archivePaths)
+	if err != nil {
+		return err
+	}
+	for _, a := range chain {
+		m := a.manifest
+		fmt.Printf("%s: %d entries verified\n", a.path, len(a.archived))
+		fmt.Printf("ID:             %s\n", m.ID)
+		if m.isDelta() {
+			fmt.Printf("Base:           %s\n", m.BaseID)
+			fmt.Printf("Deleted:        %d\n", len(m.Deleted))
+		}
+		fmt.Printf("Source:         %s\n", m.Source)
+		fmt.Printf("Created:        %s\n", m.Created.Format(time.RFC3339))
+		fmt.Printf("Tool version:   %s\n", m.ToolVersion)
+		fmt.Printf("Keyring terms:  %s\n", formatTerms(m.Terms))
+	}
+	return nil
+}
+
+// verifiedArchive is an archive whose entries have been checked against its
+// manifest.
+type verifiedArchive struct {
+	path     string
+	manifest *manifest
+	// archived holds the hashes of the entries in the archive.
+	archived map[string]string
+}
+
+// verifyChain verifies each archive, then checks that each is a delta
+// based on the one before it.
+func verifyChain(archivePaths []string) ([]*verifiedArchive, error) {
+	var chain []*verifiedArchive
+	for i, p := range archivePaths {
+		a, err := verifyFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			if !a.manifest.isDelta() {
+				return nil, fmt.Errorf("%s: is a full snapshot; only deltas may follow %s", p, archivePaths[i-1])
+			}
+			if err := a.manifest.follows(chain[i-1].manifest, a.archived); err != nil {
+				return nil, fmt.Errorf("%s: does not follow %s: %v", p, archivePaths[i-1], err)
+			}
+		}
+		chain = append(chain, a)
+	}
+	return chain, nil
+}
+
+func verifyFile(archivePath string) (*verifiedArchive, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	m, archived, err := verifyArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", archivePath, err)
+	}
+	return &verifiedArchive{path: archivePath, manifest: m, archived: archived}, nil
+}
+
+// checkEmpty refuses to restore over existing data.
+func checkEmpty(backendPath string) error {
+	d, err := os.Open(backendPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close() // nolint: errcheck
+
+	names, err := d.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s is not empty", backendPath)
+	}
+	return nil
+}
+
+// syncDir flushes a directory, so that a file renamed into it survives a
+// crash.
+func syncDir(path string) (err error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeError := d.Close(); closeError != nil && err == nil {
+			err = closeError
+		}
+	}()
+	return d.Sync()
+}
+
+func formatTerms(terms []uint32) string {
+	if len(terms) == 0 {
+		return "none"
+	}
+	s := make([]string, len(terms))
+	for i, t := range terms {
+		s[i] = fmt.Sprint(t)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/vault/physical"
+
+	"github.com/saj/vault-tools/internal/backend"
+)
+
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "vault-snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeExport writes a Consul KV export holding entries.
+func writeExport(t *testing.T, path string, entries map[string]string) {
+	t.Helper()
+	sink, err := backend.OpenConsulExportSink(path, "vault", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range sortedKeys(entries) {
+		entry := &physical.Entry{Key: key, Value: []byte(entries[key])}
+		if err := sink.WriteEntry(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestCreateVerifyDeltaChain(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	export := filepath.Join(dir, "vault.json")
+	full := filepath.Join(dir, "full.tar.gz")
+	saved := filepath.Join(dir, "full.manifest")
+	delta := filepath.Join(dir, "delta.tar.gz")
+
+	writeExport(t, export, map[string]string{
+		"core/keyring":    "keyring",
+		"logical/a":       "a",
+		"logical/b":       "b",
+		"logical/deleted": "deleted",
+	})
+	if err := create(ctx, "", export, "vault", true, "", saved, full, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(full + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary archive left behind")
+	}
+
+	writeExport(t, export, map[string]string{
+		"core/keyring": "keyring",
+		"logical/a":    "a",
+		"logical/b":    "changed",
+		"logical/c":    "added",
+	})
+	if err := create(ctx, "", export, "vault", false, saved, "", delta, false); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := verifyChain([]string{full, delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(chain[1].archived); n != 2 {
+		t.Errorf("delta archived %d entries, want 2", n)
+	}
+	if d := chain[1].manifest.Deleted; len(d) != 1 || d[0] != "logical/deleted" {
+		t.Errorf("delta deleted %q, want [logical/deleted]", d)
+	}
+	if _, err := verifyChain([]string{delta}); err != nil {
+		t.Errorf("verify delta alone: %v", err)
+	}
+	if _, err := verifyChain([]string{delta, full}); err == nil {
+		t.Error("verified a full snapshot following a delta")
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := restore(ctx, []string{full, delta}, restored, false); err != nil {
+		t.Fatal(err)
+	}
+	value, err := ioutil.ReadFile(filepath.Join(restored, "logical", "_b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(value, []byte("Y2hhbmdlZA==")) {
+		t.Errorf("logical/b: got %s, want the changed value", value)
+	}
+	if _, err := os.Stat(filepath.Join(restored, "logical", "_deleted")); !os.IsNotExist(err) {
+		t.Error("logical/deleted was restored")
+	}
+}
+
+func TestVerifyTamperedManifest(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	export := filepath.Join(dir, "vault.json")
+	archive := filepath.Join(dir, "full.tar")
+
+	writeExport(t, export, map[string]string{
+		"logical/a": "a",
+		"logical/b": "b",
+	})
+	if err := create(context.Background(), "", export, "vault", false, "", "", archive, false); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record a different checksum for logical/a.
+	sum := []byte(hashValue([]byte("a")))
+	if !bytes.Contains(buf, sum) {
+		t.Fatal("checksum not found in manifest")
+	}
+	tampered := append([]byte(nil), sum...)
+	tampered[0] ^= 1
+	if err := ioutil.WriteFile(archive, bytes.Replace(buf, sum, tampered, 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyChain([]string{archive}); err == nil {
+		t.Error("verified an archive with a tampered manifest")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/saj/vault-tools/internal/layout"
+)
+
+// manifestFormatVersion is incremented whenever the archive layout changes
+// incompatibly.
+const manifestFormatVersion = 1
+
+// manifest describes the contents of a snapshot archive.  It is written as
+// the final member of the archive, once every entry has been hashed.
+//
+// Entries always describes the complete state of the source backend.  A full
+// archive holds every one of them.  A delta archive, which names its base in
+// BaseID, holds only those entries that were added or changed since the
+// base; entries removed since the base are listed in Deleted.
+type manifest struct {
+	FormatVersion int       `json:"format_version"`
+	ID            string    `json:"id"`
+	BaseID        string    `json:"base_id,omitempty"`
+	ToolVersion   string    `json:"tool_version"`
+	Created       time.Time `json:"created"`
+	Source        string    `json:"source"`
+	// Terms is the set of keyring terms under which the entries were
+	// encrypted.  A restored backend needs a keyring holding each of them.
+	Terms   []uint32         `json:"terms"`
+	Entries []*manifestEntry `json:"entries"`
+	Deleted []string         `json:"deleted,omitempty"`
+}
+
+type manifestEntry struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func newManifest(source string, base *manifest) (*manifest, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		FormatVersion: manifestFormatVersion,
+		ID:            hex.EncodeToString(id),
+		ToolVersion:   version,
+		Created:       time.Now().UTC(),
+		Source:        source,
+		Terms:         []uint32{},
+		Entries:       []*manifestEntry{},
+	}
+	if base != nil {
+		if base.ID == "" {
+			return nil, errors.New("base manifest has no ID; take a new full snapshot")
+		}
+		m.BaseID = base.ID
+	}
+	return m, nil
+}
+
+// readManifestFile reads a manifest saved with --save-manifest, or the
+// manifest at the end of an archive.
+func readManifestFile(manifestPath string) (*manifest, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	br := bufio.NewReader(f)
+	if b, err := br.Peek(1); err == nil && b[0] == '{' {
+		m := &manifest{}
+		if err := json.NewDecoder(br).Decode(m); err != nil {
+			return nil, fmt.Errorf("%s: %v", manifestPath, err)
+		}
+		return m, nil
+	}
+
+	m, err := readArchive(br, func(key string, value []byte) error { return nil })
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestPath, err)
+	}
+	return m, nil
+}
+
+func (m *manifest) isDelta() bool {
+	return m.BaseID != ""
+}
+
+// sums maps each key in the manifest to its hash.
+func (m *manifest) sums() map[string]string {
+	sums := make(map[string]string, len(m.Entries))
+	for _, e := range m.Entries {
+		sums[e.Key] = e.SHA256
+	}
+	return sums
+}
+
+// add records a physical entry.  The keyring term is read from the
+// ciphertext framing; no key material is needed.
+func (m *manifest) add(key, sum string, value []byte) {
+	m.Entries = append(m.Entries, &manifestEntry{
+		Key:    key,
+		Size:   len(value),
+		SHA256: sum,
+	})
+
+	if key == layout.KeyringPath || layout.UnencryptedKeys[key] {
+		return
+	}
+	h, err := layout.ParseHeader(value)
+	if err != nil {
+		return
+	}
+	i := sort.Search(len(m.Terms), func(i int) bool { return m.Terms[i] >= h.Term })
+	if i < len(m.Terms) && m.Terms[i] == h.Term {
+		return
+	}
+	m.Terms = append(m.Terms, 0)
+	copy(m.Terms[i+1:], m.Terms[i:])
+	m.Terms[i] = h.Term
+}
+
+// check compares the hashes of the entries found in an archive against the
+// manifest.  Every archived entry must be listed.  A full archive must hold
+// every listed entry; a delta archive may omit those left unchanged since
+// its base.
+func (m *manifest) check(found map[string]string) error {
+	if m.FormatVersion != manifestFormatVersion {
+		return fmt.Errorf("unsupported archive format version: %d", m.FormatVersion)
+	}
+	if m.ID == "" {
+		return errors.New("manifest has no ID")
+	}
+
+	listed := make(map[string]bool, len(m.Entries))
+	for _, e := range m.Entries {
+		if listed[e.Key] {
+			return fmt.Errorf("%s: listed twice in manifest", e.Key)
+		}
+		listed[e.Key] = true
+
+		sum, ok := found[e.Key]
+		if !ok {
+			if m.isDelta() {
+				continue
+			}
+			return fmt.Errorf("%s: missing from archive", e.Key)
+		}
+		if sum != e.SHA256 {
+			return fmt.Errorf("%s: checksum mismatch", e.Key)
+		}
+	}
+	for key := range found {
+		if !listed[key] {
+			return fmt.Errorf("%s: not listed in manifest", key)
+		}
+	}
+	for _, key := range m.Deleted {
+		if listed[key] {
+			return fmt.Errorf("%s: listed as both present and deleted", key)
+		}
+	}
+	return nil
+}
+
+// follows checks that a delta manifest applies cleanly on top of base.
+// archived holds the keys present in the delta archive.  Every entry
+// omitted from the delta must be unchanged in base, and every entry in base
+// must either survive or be deleted.
+func (m *manifest) follows(base *manifest, archived map[string]string) error {
+	if m.BaseID != base.ID {
+		return fmt.Errorf("based on snapshot %s, not %s", m.BaseID, base.ID)
+	}
+
+	baseSums := base.sums()
+	sums := m.sums()
+	for _, e := range m.Entries {
+		if _, ok := archived[e.Key]; ok {
+			continue
+		}
+		if baseSums[e.Key] != e.SHA256 {
+			return fmt.Errorf("%s: not archived, and not unchanged since base", e.Key)
+		}
+	}
+	deleted := make(map[string]bool, len(m.Deleted))
+	for _, key := range m.Deleted {
+		if _, ok := baseSums[key]; !ok {
+			return fmt.Errorf("%s: deleted, but absent from base", key)
+		}
+		deleted[key] = true
+	}
+	for key := range baseSums {
+		if _, ok := sums[key]; !ok && !deleted[key] {
+			return fmt.Errorf("%s: absent, but not listed as deleted", key)
+		}
+	}
+	return nil
+}
+
+func hashValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeManifest is shared by archives and --save-manifest so that both
+// copies are byte-for-byte identical.
+func encodeManifest(m *manifest) ([]byte, error) {
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// saveManifest writes m to manifestPath for use as the --base of a later
+// delta.
+func saveManifest(m *manifest, manifestPath string) error {
+	buf, err := encodeManifest(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, buf, 0600)
+}
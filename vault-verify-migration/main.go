@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	hclog "github.com/hashicorp/go-hclog"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/saj/vault-tools/internal/backend"
+	"github.com/saj/vault-tools/internal/lock"
+)
+
+const progname = "vault-verify-migration"
+
+func main() {
+	app := kingpin.New(progname,
+		"Check that two Vault storage backends hold the same data.  The key sets are compared, and the SHA-256 of every value.  Entries are compared verbatim, still encrypted; the Vault master key is not required.\n\n"+
+			"Keys that differ are listed on standard output, and the program exits non-zero.\n\n"+
+			"Backends are named as scheme:address, as for vault-migrate.  The schemes are:\n\n"+
+			"    file:PATH            a Vault filesystem storage backend\n"+
+			"    consul:ADDR          the KV store of a live Consul agent, such as 127.0.0.1:8500 or https://consul.example:8501\n"+
+			"    consul-export:FILE   a JSON-serialised Consul KV tree ('consul kv export')\n"+
+			"    consul-txn:DIR       a directory of Consul transaction API payloads, each of up to 64 keys\n"+
+			"    jsonl:FILE           one JSON object per line, with key and base64 value fields; - is standard input\n\n"+
+			"Example:\n\n"+
+			"    vault-verify-migration consul-export:vault.json file:backend\n").
+		UsageTemplate(kingpin.CompactUsageTemplate)
+	opts := &backend.Options{}
+	app.Flag("consul-path",
+		"Consul key prefix for Vault data.  See https://www.vaultproject.io/docs/configuration/storage/consul.html#path").
+		Default("vault").StringVar(&opts.ConsulPath)
+	backend.ConsulFlags(app, opts)
+	filter := &backend.Filter{}
+	backend.FilterFlags(app, filter)
+	app.Flag("parallel",
+		"Maximum number of concurrent operations against a file: source or destination.").
+		Default(strconv.Itoa(backend.DefaultParallel)).IntVar(&opts.Parallel)
+	force := app.Flag("force",
+		"Read a filesystem backend even if a Vault server appears to be using it.  The program takes a shared advisory lock on PATH.lock for each filesystem backend, so that several verifications may run at once, and refuses to run if a process holds core/lock open or if the backend was modified in the last few minutes by something other than these tools.").
+		Bool()
+	source := app.Arg("source",
+		"Source backend.").
+		Required().String()
+	destination := app.Arg("destination",
+		"Destination backend.").
+		Required().String()
+
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var locks []*lock.Lock
+	release := func() {
+		for _, l := range locks {
+			l.Release() // nolint: errcheck
+		}
+		locks = nil
+	}
+	app.Terminate(func(status int) {
+		release()
+		os.Exit(status)
+	})
+	for _, spec := range []string{*source, *destination} {
+		scheme, addr, err := backend.ParseSpec(spec)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		if scheme != backend.SchemeFile {
+			continue
+		}
+		l, err := lock.AcquireShared(addr, *force)
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+		locks = append(locks, l)
+	}
+
+	opts.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:  progname,
+		Level: hclog.LevelFromString("INFO"),
+	})
+	n, mismatches, err := backend.VerifySpecs(ctx, *source, *destination, filter, opts)
+	release()
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
+
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) > 0 {
+		app.Fatalf("%d mismatched keys", len(mismatches))
+	}
+	fmt.Fprintf(os.Stderr, "%s: verified %d entries\n", progname, n)
+}